@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var trustedProxyNets []*net.IPNet
+
+// 解析可信代理列表，支持 CIDR 和单个 IP
+func initTrustedProxies() error {
+	trustedProxyNets = nil
+	for _, entry := range config.TrustedProxies {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return fmt.Errorf("可信代理地址无效: %q", entry)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			entry = fmt.Sprintf("%s/%d", entry, bits)
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return fmt.Errorf("可信代理地址无效: %q: %v", entry, err)
+		}
+		trustedProxyNets = append(trustedProxyNets, ipNet)
+	}
+	if len(trustedProxyNets) > 0 {
+		log.Printf("✅ 信任来自 %v 的转发头", config.TrustedProxies)
+	}
+	return nil
+}
+
+// 请求是否直接来自可信代理
+func fromTrustedProxy(r *http.Request) bool {
+	if len(trustedProxyNets) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return isTrustedProxy(host)
+}
+
+// 地址是否属于可信代理
+func isTrustedProxy(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range trustedProxyNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Forwarded 头中一个代理添加的记录
+type forwardedElement struct {
+	For   string
+	Proto string
+	Host  string
+}
+
+// 按出现顺序解析 RFC 7239 Forwarded 头中的各条记录
+func parseForwardedElements(header string) []forwardedElement {
+	var elements []forwardedElement
+	for _, part := range strings.Split(header, ",") {
+		var element forwardedElement
+		for _, pair := range strings.Split(part, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok {
+				continue
+			}
+			value = strings.Trim(value, `"`)
+			switch strings.ToLower(key) {
+			case "for":
+				element.For = value
+			case "proto":
+				element.Proto = value
+			case "host":
+				element.Host = value
+			}
+		}
+		elements = append(elements, element)
+	}
+	return elements
+}
+
+// Forwarded 的 for 节点中的地址：192.0.2.1、192.0.2.1:80、[2001:db8::1]:80
+func forwardedNodeHost(node string) string {
+	if strings.HasPrefix(node, "[") {
+		if end := strings.Index(node, "]"); end > 0 {
+			return node[1:end]
+		}
+		return node
+	}
+	if strings.Count(node, ":") == 1 {
+		host, _, _ := strings.Cut(node, ":")
+		return host
+	}
+	return node
+}
+
+// 取 Forwarded 头中客户端实际访问的 proto 和 host。记录由各代理依次追加，左侧的记录可由客户端伪造，
+// 因此从最右侧（直接连接的可信代理添加）开始向左，只经过 for 仍为可信代理的记录
+func parseForwarded(header string) (proto, host string) {
+	elements := parseForwardedElements(header)
+	if len(elements) == 0 {
+		return "", ""
+	}
+	i := len(elements) - 1
+	for i > 0 && isTrustedProxy(forwardedNodeHost(elements[i].For)) {
+		i--
+	}
+	return elements[i].Proto, elements[i].Host
+}
+
+// X-Forwarded-* 可能包含多个逗号分隔的值，左侧的值可由客户端伪造，取直接连接的可信代理设置的最后一个
+func lastHeaderValue(r *http.Request, name string) string {
+	values := r.Header.Values(name)
+	if len(values) == 0 {
+		return ""
+	}
+	value := values[len(values)-1]
+	if i := strings.LastIndex(value, ","); i >= 0 {
+		value = value[i+1:]
+	}
+	return strings.TrimSpace(value)
+}
+
+// 客户端看到的服务基础地址：
+// 配置了 publicBaseURL 时直接使用；否则来自可信代理的请求依次参考 Forwarded 和 X-Forwarded-Proto/Host/Prefix，
+// 其余情况使用请求本身的协议和 Host
+func requestBaseURL(r *http.Request) string {
+	if config.PublicBaseURL != "" {
+		return strings.TrimRight(config.PublicBaseURL, "/")
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host := r.Host
+	if host == "" {
+		host = fmt.Sprintf("%s:%d", config.Host, config.Port)
+	}
+	prefix := ""
+
+	if fromTrustedProxy(r) {
+		proto, fwdHost := parseForwarded(strings.Join(r.Header.Values("Forwarded"), ","))
+		if proto == "" {
+			proto = lastHeaderValue(r, "X-Forwarded-Proto")
+		}
+		if fwdHost == "" {
+			fwdHost = lastHeaderValue(r, "X-Forwarded-Host")
+		}
+		if proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		if fwdHost != "" && !strings.ContainsAny(fwdHost, "/\\ ") {
+			host = fwdHost
+		}
+		if p := strings.Trim(lastHeaderValue(r, "X-Forwarded-Prefix"), "/"); p != "" {
+			prefix = "/" + p
+		}
+	}
+	return scheme + "://" + host + prefix
+}
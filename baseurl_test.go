@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestBaseURLForwarded(t *testing.T) {
+	saved := config
+	defer func() {
+		config = saved
+		initTrustedProxies()
+	}()
+	config.PublicBaseURL = ""
+	config.TrustedProxies = []string{"10.0.0.0/8"}
+	if err := initTrustedProxies(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string][]string
+		want    string
+	}{
+		{
+			name:   "不可信来源忽略转发头",
+			remote: "192.0.2.1:1234",
+			headers: map[string][]string{
+				"Forwarded":        {"proto=https;host=evil.example"},
+				"X-Forwarded-Host": {"evil.example"},
+			},
+			want: "http://internal:8080",
+		},
+		{
+			name:    "单个代理",
+			remote:  "10.0.0.1:1234",
+			headers: map[string][]string{"Forwarded": {"for=192.0.2.1;proto=https;host=iiif.example.org"}},
+			want:    "https://iiif.example.org",
+		},
+		{
+			name:   "客户端伪造的 Forwarded 记录被忽略",
+			remote: "10.0.0.1:1234",
+			headers: map[string][]string{
+				"Forwarded": {`for=1.2.3.4;proto=http;host=evil.example, for="192.0.2.1:5678";proto=https;host=iiif.example.org`},
+			},
+			want: "https://iiif.example.org",
+		},
+		{
+			name:   "跳过可信代理链，取最外层可信代理的记录",
+			remote: "10.0.0.1:1234",
+			headers: map[string][]string{
+				"Forwarded": {
+					"for=1.2.3.4;host=evil.example",
+					"for=192.0.2.1;proto=https;host=iiif.example.org, for=10.0.0.2;proto=http;host=backend",
+				},
+			},
+			want: "https://iiif.example.org",
+		},
+		{
+			name:   "X-Forwarded-* 取最后一个值",
+			remote: "10.0.0.1:1234",
+			headers: map[string][]string{
+				"X-Forwarded-Proto":  {"http, https"},
+				"X-Forwarded-Host":   {"evil.example, iiif.example.org"},
+				"X-Forwarded-Prefix": {"/evil", "/images/"},
+			},
+			want: "https://iiif.example.org/images",
+		},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/iiif/3/a.jpg/info.json", nil)
+		r.Host = "internal:8080"
+		r.RemoteAddr = tt.remote
+		for name, values := range tt.headers {
+			for _, value := range values {
+				r.Header.Add(name, value)
+			}
+		}
+		if got := requestBaseURL(r); got != tt.want {
+			t.Errorf("%s: 得到 %s，期望 %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/png"
+	"strconv"
+	"strings"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// bitonal 质量配置
+type BitonalConfig struct {
+	Threshold string `yaml:"threshold"` // 阈值：otsu（按直方图自动计算）或 0-255 的固定值，默认 128
+	Dither    bool   `yaml:"dither"`    // 是否使用 Floyd-Steinberg 误差扩散抖动
+}
+
+// bitonal 配置指纹：阈值（固定值或 otsu）和是否抖动
+func bitonalFingerprint() string {
+	threshold, _ := bitonalThreshold() // 已由 initBitonal 在启动时检查
+	name := strconv.Itoa(threshold)
+	if threshold < 0 {
+		name = "otsu"
+	}
+	return fmt.Sprintf("bitonal:threshold=%s,dither=%v", name, config.Bitonal.Dither)
+}
+
+// 检查 bitonal 配置，阈值无效时拒绝启动
+func initBitonal() error {
+	if _, err := bitonalThreshold(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// 解析阈值配置，otsu 返回 -1
+func bitonalThreshold() (int, error) {
+	value := strings.ToLower(strings.TrimSpace(config.Bitonal.Threshold))
+	switch value {
+	case "":
+		return 128, nil
+	case "otsu":
+		return -1, nil
+	}
+	t, err := strconv.Atoi(value)
+	if err != nil || t < 0 || t > 255 {
+		return 0, fmt.Errorf("无效的 bitonal 阈值: %s", config.Bitonal.Threshold)
+	}
+	return t, nil
+}
+
+// 转换为只有 0 和 255 两种值的单通道 8 位图像，灰度大于阈值的像素为白色。
+// 抖动时返回新的图像并关闭 img；出错时返回的图像仍由调用方负责关闭
+func applyBitonal(img *vips.ImageRef) (*vips.ImageRef, error) {
+	// 透明区域按白色处理
+	if img.HasAlpha() {
+		if err := img.Flatten(&vips.Color{R: 255, G: 255, B: 255}); err != nil {
+			return img, err
+		}
+	}
+	if err := img.ToColorSpace(vips.InterpretationBW); err != nil {
+		return img, err
+	}
+	if img.BandFormat() == vips.BandFormatUshort {
+		if err := img.Linear1(1.0/257, 0); err != nil {
+			return img, err
+		}
+	}
+	if img.BandFormat() != vips.BandFormatUchar {
+		if err := img.Cast(vips.BandFormatUchar); err != nil {
+			return img, err
+		}
+	}
+
+	threshold, err := bitonalThreshold()
+	if err != nil {
+		return img, err
+	}
+	if threshold < 0 {
+		if threshold, err = otsuThreshold(img); err != nil {
+			return img, err
+		}
+	}
+
+	if config.Bitonal.Dither {
+		return ditherImage(img, threshold)
+	}
+
+	// v > t 时 255*(v-t) >= 255，否则 <= 0，转回 uchar 时截断为 255 或 0
+	if err := img.Linear1(255, -255*float64(threshold)); err != nil {
+		return img, err
+	}
+	return img, img.Cast(vips.BandFormatUchar)
+}
+
+// 用 Otsu 方法从灰度直方图计算使类间方差最大的阈值
+func otsuThreshold(img *vips.ImageRef) (int, error) {
+	hist, err := img.Copy()
+	if err != nil {
+		return 0, err
+	}
+	defer hist.Close()
+	if err := hist.HistogramFind(); err != nil {
+		return 0, err
+	}
+	data, err := hist.ToBytes()
+	if err != nil {
+		return 0, err
+	}
+	if len(data) < 256*4 {
+		return 0, fmt.Errorf("直方图数据长度异常: %d", len(data))
+	}
+
+	var counts [256]float64
+	var total, sum float64
+	for i := range counts {
+		counts[i] = float64(binary.NativeEndian.Uint32(data[i*4:]))
+		total += counts[i]
+		sum += float64(i) * counts[i]
+	}
+
+	best, bestVariance := 128, -1.0
+	var weightB, sumB float64
+	for t := 0; t < 256; t++ {
+		weightB += counts[t]
+		if weightB == 0 {
+			continue
+		}
+		weightF := total - weightB
+		if weightF == 0 {
+			break
+		}
+		sumB += float64(t) * counts[t]
+		meanB := sumB / weightB
+		meanF := (sum - sumB) / weightF
+		variance := weightB * weightF * (meanB - meanF) * (meanB - meanF)
+		if variance > bestVariance {
+			best, bestVariance = t, variance
+		}
+	}
+	return best, nil
+}
+
+// Floyd-Steinberg 误差扩散抖动，libvips 没有对应的操作，在内存中处理后重新载入
+func ditherImage(img *vips.ImageRef, threshold int) (*vips.ImageRef, error) {
+	width, height := img.Width(), img.Height()
+	data, err := img.ToBytes()
+	if err != nil {
+		return img, err
+	}
+	if len(data) < width*height {
+		return img, fmt.Errorf("图像数据长度异常: %d", len(data))
+	}
+
+	out := floydSteinberg(data, width, height, threshold)
+
+	var buf bytes.Buffer
+	encoder := png.Encoder{CompressionLevel: png.BestSpeed}
+	if err := encoder.Encode(&buf, out); err != nil {
+		return img, err
+	}
+	dithered, err := vips.NewImageFromBuffer(buf.Bytes())
+	if err != nil {
+		return img, err
+	}
+	img.Close()
+	return dithered, nil
+}
+
+// 对 8 位灰度像素做 Floyd-Steinberg 抖动，大于阈值的像素量化为白色
+func floydSteinberg(data []byte, width, height, threshold int) *image.Gray {
+	out := image.NewGray(image.Rect(0, 0, width, height))
+	// 当前行和下一行的累计误差，两端各留一个位置避免边界判断
+	cur := make([]int, width+2)
+	next := make([]int, width+2)
+	for y := 0; y < height; y++ {
+		row := data[y*width : (y+1)*width]
+		for x := 0; x < width; x++ {
+			v := int(row[x]) + cur[x+1]/16
+			var q int
+			if v > threshold {
+				q = 255
+			}
+			out.Pix[y*out.Stride+x] = uint8(q)
+			e := v - q
+			cur[x+2] += e * 7
+			next[x] += e * 3
+			next[x+1] += e * 5
+			next[x+2] += e
+		}
+		cur, next = next, cur
+		for i := range next {
+			next[i] = 0
+		}
+	}
+	return out
+}
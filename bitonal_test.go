@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/png"
+	"testing"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// 由 8 位灰度像素生成测试图像
+func grayImage(t *testing.T, width int, pix []uint8) *vips.ImageRef {
+	t.Helper()
+	g := image.NewGray(image.Rect(0, 0, width, len(pix)/width))
+	copy(g.Pix, pix)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	img, err := vips.NewImageFromBuffer(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func setBitonalConfig(t *testing.T, cfg BitonalConfig) {
+	saved := config.Bitonal
+	config.Bitonal = cfg
+	t.Cleanup(func() { config.Bitonal = saved })
+}
+
+// 对测试图像做 bitonal 处理，返回结果像素
+func bitonalPixels(t *testing.T, width int, pix []uint8) []uint8 {
+	t.Helper()
+	out, err := applyBitonal(grayImage(t, width, pix))
+	defer out.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Bands() != 1 || out.BandFormat() != vips.BandFormatUchar {
+		t.Fatalf("输出应为单通道 8 位图像，得到 bands=%d format=%v", out.Bands(), out.BandFormat())
+	}
+	data, err := out.ToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func assertPixels(t *testing.T, name string, got, want []uint8) {
+	t.Helper()
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s:\n得到 %v\n期望 %v", name, got, want)
+	}
+}
+
+func TestInitBitonal(t *testing.T) {
+	tests := []struct {
+		threshold string
+		ok        bool
+	}{
+		{"", true}, {"0", true}, {"255", true}, {" 100 ", true}, {"otsu", true}, {"OTSU", true},
+		{"256", false}, {"-1", false}, {"12.5", false}, {"auto", false},
+	}
+	for _, tt := range tests {
+		setBitonalConfig(t, BitonalConfig{Threshold: tt.threshold})
+		if err := initBitonal(); (err == nil) != tt.ok {
+			t.Errorf("threshold=%q: err=%v", tt.threshold, err)
+		}
+	}
+}
+
+func TestBitonalFixedThreshold(t *testing.T) {
+	pix := []uint8{0, 100, 128, 129, 200, 255}
+
+	setBitonalConfig(t, BitonalConfig{})
+	assertPixels(t, "默认阈值 128", bitonalPixels(t, 6, pix), []uint8{0, 0, 0, 255, 255, 255})
+
+	setBitonalConfig(t, BitonalConfig{Threshold: "100"})
+	assertPixels(t, "阈值 100", bitonalPixels(t, 6, pix), []uint8{0, 0, 255, 255, 255, 255})
+}
+
+func TestBitonalOtsu(t *testing.T) {
+	// 两种灰度都高于 128，固定阈值会得到全白，Otsu 阈值落在两者之间
+	pix := []uint8{
+		150, 150, 250, 250,
+		150, 250, 150, 250,
+	}
+
+	setBitonalConfig(t, BitonalConfig{})
+	assertPixels(t, "固定阈值", bitonalPixels(t, 4, pix), []uint8{255, 255, 255, 255, 255, 255, 255, 255})
+
+	img := grayImage(t, 4, pix)
+	defer img.Close()
+	threshold, err := otsuThreshold(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if threshold < 150 || threshold >= 250 {
+		t.Errorf("Otsu 阈值 %d 不在 [150, 250) 内", threshold)
+	}
+
+	setBitonalConfig(t, BitonalConfig{Threshold: "otsu"})
+	assertPixels(t, "Otsu", bitonalPixels(t, 4, pix), []uint8{
+		0, 0, 255, 255,
+		0, 255, 0, 255,
+	})
+}
+
+func TestBitonalDither(t *testing.T) {
+	pix := bytes.Repeat([]uint8{100}, 6*4)
+
+	setBitonalConfig(t, BitonalConfig{})
+	assertPixels(t, "不抖动", bitonalPixels(t, 6, pix), make([]uint8, 6*4))
+
+	setBitonalConfig(t, BitonalConfig{Dither: true})
+	assertPixels(t, "Floyd-Steinberg", bitonalPixels(t, 6, pix), []uint8{
+		0, 255, 0, 0, 255, 0,
+		0, 0, 255, 0, 0, 255,
+		255, 0, 255, 0, 255, 0,
+		0, 255, 0, 0, 255, 0,
+	})
+}
+
+// 读取 TIFF 第一个 IFD 中 SHORT 类型标签的值
+func tiffShortTag(t *testing.T, data []byte, tag uint16) int {
+	t.Helper()
+	var order binary.ByteOrder = binary.LittleEndian
+	if string(data[:2]) == "MM" {
+		order = binary.BigEndian
+	}
+	ifd := int(order.Uint32(data[4:]))
+	n := int(order.Uint16(data[ifd:]))
+	for i := 0; i < n; i++ {
+		entry := data[ifd+2+i*12:]
+		if order.Uint16(entry) == tag {
+			return int(order.Uint16(entry[8:]))
+		}
+	}
+	t.Fatalf("TIFF 中没有标签 %d", tag)
+	return 0
+}
+
+func TestBitonalExportOneBit(t *testing.T) {
+	setBitonalConfig(t, BitonalConfig{})
+	pix := make([]uint8, 16*16)
+	for i := range pix {
+		pix[i] = uint8(i)
+	}
+	img, err := applyBitonal(grayImage(t, 16, pix))
+	defer img.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := img.ToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []string{"png", "tif"} {
+		data, err := exportImage(img, IIIFRequest{Identifier: "a.tif", Quality: "bitonal", Format: format})
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		switch format {
+		case "png":
+			// IHDR 紧跟 8 字节签名：长度(4) "IHDR"(4) 宽(4) 高(4) 位深(1) 颜色类型(1)
+			if string(data[12:16]) != "IHDR" || data[24] != 1 || data[25] != 0 {
+				t.Errorf("png 应为 1 位灰度，得到 bitdepth=%d colortype=%d", data[24], data[25])
+			}
+		case "tif":
+			if bits := tiffShortTag(t, data, 258); bits != 1 {
+				t.Errorf("tif BitsPerSample=%d，期望 1", bits)
+			}
+			if compression := tiffShortTag(t, data, 259); compression != 4 {
+				t.Errorf("tif Compression=%d，期望 4 (CCITT G4)", compression)
+			}
+		}
+
+		decoded, err := vips.NewImageFromBuffer(data)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		got, err := decoded.ToBytes()
+		decoded.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertPixels(t, format+" 往返", got, want)
+	}
+}
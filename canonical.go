@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 看起来像图像请求（末段为 质量.格式）但不符合语法的路径返回 400，其余视为基础 URI
+var looseImageRequestRegex = regexp.MustCompile(`^.+/[^/]+/[^/]+/[^/]+/(default|color|gray|bitonal|native)\.[^/]+$`)
+
+// 基础 URI（只有标识符）按规范 303 重定向到 info.json
+func isBaseURIRequest(path string) bool {
+	return path != "" && !looseImageRequestRegex.MatchString(path)
+}
+
+// 对应 API 版本的合规级别 profile
+func (rt iiifRoute) profileURI() string {
+	if rt.API == 2 {
+		return "http://iiif.io/api/image/2/level2.json"
+	}
+	return "http://iiif.io/api/image/3/level2.json"
+}
+
+// 计算图像请求的规范形式（IIIF 3.0 或 2.1 的 canonical URI 语法），width/height 为原图尺寸
+func canonicalRequest(req IIIFRequest, width, height, api int) (IIIFRequest, error) {
+	x, y, w, h, err := computeRegion(req.Region, width, height)
+	if err != nil {
+		return req, err
+	}
+	region := "full"
+	if x != 0 || y != 0 || w != width || h != height {
+		region = fmt.Sprintf("%d,%d,%d,%d", x, y, w, h)
+	}
+
+	tw, th, err := computeSize(req.Size, w, h)
+	if err != nil {
+		return req, err
+	}
+	var size string
+	switch {
+	case api == 2 && tw == w && th == h:
+		size = "full"
+	case api == 2 && int(math.Max(1, math.Round(float64(h)*float64(tw)/float64(w)))) == th:
+		size = fmt.Sprintf("%d,", tw)
+	case api == 2:
+		size = fmt.Sprintf("%d,%d", tw, th)
+	case tw == w && th == h:
+		size = "max"
+	case tw > w || th > h:
+		size = fmt.Sprintf("^%d,%d", tw, th)
+	default:
+		size = fmt.Sprintf("%d,%d", tw, th)
+	}
+
+	mirror, angle, err := parseRotation(req.Rotation)
+	if err != nil {
+		return req, err
+	}
+	rotation := strconv.FormatFloat(angle, 'f', -1, 64)
+	if mirror {
+		rotation = "!" + rotation
+	}
+
+	quality := req.Quality
+	if quality == "color" {
+		quality = "default"
+	}
+	format := req.Format
+	if format == "jpeg" {
+		format = "jpg"
+	}
+
+	return IIIFRequest{
+		Identifier: req.Identifier,
+		Region:     region,
+		Size:       size,
+		Rotation:   rotation,
+		Quality:    quality,
+		Format:     format,
+	}, nil
+}
+
+// 图像请求的完整 URI
+func (rt iiifRoute) imageURL(r *http.Request, req IIIFRequest) string {
+	return fmt.Sprintf("%s/%s/%s/%s/%s.%s",
+		rt.serviceID(r, req.Identifier), req.Region, req.Size, req.Rotation, req.Quality, req.Format)
+}
+
+// 图像响应的 Link 头：规范形式 URI 和合规级别 profile。
+// 规范形式需要原图尺寸，只在元数据缓存中已有时添加，不为此读取或解码原图（派生图缓存命中时尤其如此）
+func writeLinkHeaders(c *gin.Context, rt iiifRoute, req IIIFRequest, version string) {
+	c.Writer.Header().Add("Link", fmt.Sprintf(`<%s>;rel="profile"`, rt.profileURI()))
+
+	dims, ok := knownImageDims(req.Identifier, version)
+	if !ok {
+		return
+	}
+	canonical, err := canonicalRequest(req, dims.Width, dims.Height, rt.API)
+	if err != nil {
+		return
+	}
+	c.Writer.Header().Add("Link", fmt.Sprintf(`<%s>;rel="canonical"`, rt.imageURL(c.Request, canonical)))
+}
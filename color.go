@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// ICC 色彩管理配置
+type ColorConfig struct {
+	Enabled         bool     `yaml:"enabled"`         // 是否启用色彩管理
+	OutputProfile   string   `yaml:"outputProfile"`   // 输出 ICC profile 文件路径，留空使用内置 sRGB
+	EmbedProfile    bool     `yaml:"embedProfile"`    // 是否在输出图像中嵌入输出 profile
+	PreserveFormats []string `yaml:"preserveFormats"` // 这些格式在 default/color 质量下保留原图色彩空间和 profile
+}
+
+// 输出 profile 文件内容的摘要，替换 profile 文件后旧派生图随之失效
+var outputProfileDigest string
+
+// 检查色彩管理配置
+func initColorManagement() error {
+	cfg := config.Color
+	outputProfileDigest = ""
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.OutputProfile != "" {
+		data, err := os.ReadFile(cfg.OutputProfile)
+		if err != nil {
+			return fmt.Errorf("输出 profile 不可用: %v", err)
+		}
+		hash := sha256.Sum256(data)
+		outputProfileDigest = hex.EncodeToString(hash[:8])
+	}
+	for _, name := range cfg.PreserveFormats {
+		if _, ok := lookupFormat(name); !ok {
+			log.Printf("警告: color.preserveFormats 中的格式 %s 不受支持", name)
+		}
+	}
+	log.Printf("✅ 色彩管理已启用: output=%s embed=%v", outputProfileName(), cfg.EmbedProfile)
+	return nil
+}
+
+func outputProfileName() string {
+	if config.Color.OutputProfile != "" {
+		return config.Color.OutputProfile
+	}
+	return "sRGB"
+}
+
+func outputProfilePath() string {
+	if config.Color.OutputProfile != "" {
+		return config.Color.OutputProfile
+	}
+	return vips.SRGBIEC6196621ICCProfilePath
+}
+
+// 色彩管理指纹：是否启用、是否保留原图色彩、输出 profile（含文件内容摘要）和是否嵌入
+func colorFingerprint(req IIIFRequest) string {
+	switch {
+	case !config.Color.Enabled:
+		return "color:off"
+	case preserveSourceColor(req):
+		return "color:preserve"
+	}
+	output := "sRGB"
+	if config.Color.OutputProfile != "" {
+		output = config.Color.OutputProfile + "#" + outputProfileDigest
+	}
+	return fmt.Sprintf("color:output=%s,embed=%v", output, config.Color.EmbedProfile)
+}
+
+// 是否保留原图色彩：归档类格式的 default/color 输出不做转换
+func preserveSourceColor(req IIIFRequest) bool {
+	if req.Quality != "default" && req.Quality != "color" {
+		return false
+	}
+	format := req.Format
+	if format == "jpeg" {
+		format = "jpg"
+	}
+	for _, name := range config.Color.PreserveFormats {
+		if name == format {
+			return true
+		}
+	}
+	return false
+}
+
+// 将图像从嵌入的 ICC profile（CMYK 无 profile 时使用 libvips 内置 CMYK profile）转换到输出 profile，
+// LAB 等非设备色彩空间先按色度学转换为 sRGB。没有 profile 的 RGB/灰度图像视为 sRGB
+func applyColorManagement(img *vips.ImageRef, req IIIFRequest) error {
+	if !config.Color.Enabled || preserveSourceColor(req) {
+		return nil
+	}
+
+	switch img.Interpretation() {
+	case vips.InterpretationLAB, vips.InterpretationLABS, vips.InterpretationLABQ,
+		vips.InterpretationLCH, vips.InterpretationCMC, vips.InterpretationXYZ,
+		vips.InterpretationYXY, vips.InterpretationScRGB:
+		if err := img.ToColorSpace(vips.InterpretationSRGB); err != nil {
+			return fmt.Errorf("转换到 sRGB 失败: %v", err)
+		}
+		// 原图的 LAB profile 已不适用
+		if img.HasICCProfile() {
+			if err := img.RemoveICCProfile(); err != nil {
+				return err
+			}
+		}
+	}
+
+	cmyk := img.Interpretation() == vips.InterpretationCMYK
+	if cmyk || img.HasICCProfile() || config.Color.OutputProfile != "" {
+		fallback := vips.SRGBIEC6196621ICCProfilePath
+		switch {
+		case cmyk:
+			fallback = "cmyk"
+		case img.Bands() <= 2:
+			fallback = vips.SGrayV2MicroICCProfilePath
+		}
+		if err := img.TransformICCProfileWithFallback(outputProfilePath(), fallback); err != nil {
+			return fmt.Errorf("ICC 转换失败: %v", err)
+		}
+	}
+
+	if !config.Color.EmbedProfile && img.HasICCProfile() {
+		return img.RemoveICCProfile()
+	}
+	return nil
+}
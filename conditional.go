@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HTTP 缓存头配置
+type HTTPCacheConfig struct {
+	CacheControl     string `yaml:"cacheControl"`     // 图片响应的 Cache-Control，为空时不发送
+	InfoCacheControl string `yaml:"infoCacheControl"` // info.json 响应的 Cache-Control，为空时不发送
+}
+
+// 原图版本：MinIO 使用对象 ETag，本地文件使用修改时间和大小
+func sourceVersion(info SourceInfo) string {
+	if info.ETag != "" {
+		return "etag:" + info.ETag
+	}
+	return fmt.Sprintf("mtime:%d-%d", info.ModTime.UnixNano(), info.Size)
+}
+
+// 由原图版本和规范化请求生成强 ETag
+func makeETag(version string, parts ...string) string {
+	hash := sha256.Sum256([]byte(version + "\x00" + strings.Join(parts, "\x00")))
+	return `"` + hex.EncodeToString(hash[:16]) + `"`
+}
+
+// 写入 ETag、Last-Modified 和 Cache-Control
+func writeValidators(c *gin.Context, etag string, lastModified time.Time, cacheControl string) {
+	c.Header("ETag", etag)
+	if !lastModified.IsZero() {
+		c.Header("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+	if cacheControl != "" {
+		c.Header("Cache-Control", cacheControl)
+	}
+}
+
+// 判断条件请求是否可以返回 304：If-None-Match 优先，其次 If-Modified-Since
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && !lastModified.IsZero() {
+		t, err := http.ParseTime(ims)
+		if err == nil && !lastModified.Truncate(time.Second).After(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// 写入缓存头，条件请求命中时直接返回 304
+func checkConditional(c *gin.Context, etag string, lastModified time.Time, cacheControl string) bool {
+	writeValidators(c, etag, lastModified, cacheControl)
+	if notModified(c.Request, etag, lastModified) {
+		c.Status(http.StatusNotModified)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+var derivCache *tieredCache // 派生图（处理后输出的图片）缓存
+
+// 初始化派生图缓存，Redis层默认24小时过期
+func initDerivativeCache() error {
+	dc, err := openTieredCache(config.DerivativeCache, "派生图", "derivatives", "iiif:derivative:", 24*time.Hour)
+	if err != nil {
+		return err
+	}
+	derivCache = dc
+	return nil
+}
+
+// 规范化请求参数和编码参数，保证等价请求得到相同的缓存键。元组同时用于派生图缓存键和 ETag，
+// 其中包含影响输出的配置指纹（编码参数、色彩管理、bitonal 设置），修改这些配置后旧的派生图和 ETag 不再匹配
+func canonicalRequestTuple(req IIIFRequest) []string {
+	format := req.Format
+	if format == "jpeg" {
+		format = "jpg"
+	}
+	size := req.Size
+	if size == "full" {
+		size = "max"
+	}
+	quality := req.Quality
+	if quality == "color" {
+		quality = "default"
+	}
+	tuple := []string{strings.Trim(req.Identifier, "/"), req.Region, size, req.Rotation, quality, format,
+		encodingProfile(req.Identifier, format).fingerprint(), colorFingerprint(req)}
+	if quality == "bitonal" {
+		tuple = append(tuple, bitonalFingerprint())
+	}
+	return tuple
+}
+
+// 派生图缓存键：原图版本和规范化的请求元组
+func derivativeCacheKey(req IIIFRequest, version string) string {
+	hash := sha256.Sum256([]byte(version + "\x00" + strings.Join(canonicalRequestTuple(req), "\x00")))
+	return hex.EncodeToString(hash[:])
+}
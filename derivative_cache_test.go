@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCanonicalRequestTupleBitonalConfig(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+
+	key := func(quality string) string {
+		req := IIIFRequest{Identifier: "a.jpg", Region: "full", Size: "max", Rotation: "0", Quality: quality, Format: "png"}
+		return strings.Join(canonicalRequestTuple(req), "\x00")
+	}
+
+	config.Bitonal = BitonalConfig{Threshold: "128"}
+	bitonal, gray := key("bitonal"), key("gray")
+
+	config.Bitonal = BitonalConfig{}
+	if key("bitonal") != bitonal {
+		t.Error("未配置阈值与阈值 128 等价，缓存键应相同")
+	}
+	for _, cfg := range []BitonalConfig{{Threshold: "100"}, {Threshold: "otsu"}, {Threshold: "128", Dither: true}} {
+		config.Bitonal = cfg
+		if key("bitonal") == bitonal {
+			t.Errorf("bitonal 配置 %+v 应改变 bitonal 请求的缓存键", cfg)
+		}
+		if key("gray") != gray {
+			t.Errorf("bitonal 配置 %+v 不应改变 gray 请求的缓存键", cfg)
+		}
+	}
+}
+
+func TestCanonicalRequestTupleColorConfig(t *testing.T) {
+	saved := config
+	defer func() {
+		config = saved
+		outputProfileDigest = ""
+	}()
+
+	key := func(quality, format string) string {
+		req := IIIFRequest{Identifier: "a.jpg", Region: "full", Size: "max", Rotation: "0", Quality: quality, Format: format}
+		return strings.Join(canonicalRequestTuple(req), "\x00")
+	}
+
+	config.Color = ColorConfig{Enabled: true}
+	base := key("default", "jpg")
+	if key("color", "jpeg") != base {
+		t.Error("color/jpeg 与 default/jpg 等价，缓存键应相同")
+	}
+	for _, cfg := range []ColorConfig{
+		{Enabled: false},
+		{Enabled: true, EmbedProfile: true},
+		{Enabled: true, OutputProfile: "/profiles/adobe.icc"},
+		{Enabled: true, PreserveFormats: []string{"jpg"}},
+	} {
+		config.Color = cfg
+		if key("default", "jpg") == base {
+			t.Errorf("色彩配置 %+v 应改变缓存键", cfg)
+		}
+	}
+
+	// preserveFormats 只影响其中格式的 default/color 请求
+	config.Color = ColorConfig{Enabled: true, PreserveFormats: []string{"tif"}}
+	if key("default", "jpg") != base {
+		t.Error("preserveFormats 不包含 jpg 时不应改变 jpg 的缓存键")
+	}
+
+	// 同一路径的输出 profile 内容变化
+	config.Color = ColorConfig{Enabled: true, OutputProfile: "/profiles/out.icc"}
+	outputProfileDigest = "aaaa"
+	before := key("default", "jpg")
+	outputProfileDigest = "bbbb"
+	if key("default", "jpg") == before {
+		t.Error("输出 profile 内容变化应改变缓存键")
+	}
+}
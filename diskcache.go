@@ -0,0 +1,287 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 按字节数限制大小的 LRU 磁盘缓存，cacheDir 下的各类缓存作为分区共享同一个容量上限
+// 文件按 dir/<分区>/<key前两位>/<key> 存放，文件修改时间记录最近访问时间，重启后据此重建 LRU 顺序
+type DiskCache struct {
+	dir     string
+	maxSize int64 // 最大缓存大小(字节)，<=0 表示不限制
+
+	mu          sync.Mutex
+	currentSize int64 // 当前缓存大小
+	lru         *list.List
+	items       map[string]*list.Element
+
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions atomic.Int64
+}
+
+type diskCacheEntry struct {
+	key  string // 分区/键
+	size int64
+	gen  uint64 // 每次覆盖写入加一，用于判断条目是否已被并发更新
+}
+
+// 磁盘缓存统计信息
+type DiskCacheStats struct {
+	Entries   int   `json:"entries"`
+	Size      int64 `json:"size"`
+	MaxSize   int64 `json:"maxSize"`
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+}
+
+// 创建磁盘缓存并从目录重建索引
+func newDiskCache(dir string, maxSize int64) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("创建缓存目录失败: %v", err)
+	}
+	dc := &DiskCache{
+		dir:     dir,
+		maxSize: maxSize,
+		lru:     list.New(),
+		items:   map[string]*list.Element{},
+	}
+	if err := dc.rebuild(); err != nil {
+		return nil, err
+	}
+	return dc, nil
+}
+
+// 扫描缓存目录重建索引，按修改时间从旧到新排列，并清理残留的临时文件
+func (dc *DiskCache) rebuild() error {
+	type found struct {
+		key     string
+		size    int64
+		modTime time.Time
+	}
+	var files []found
+
+	err := filepath.WalkDir(dc.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if strings.HasSuffix(d.Name(), ".tmp") {
+			os.Remove(path)
+			return nil
+		}
+		rel, err := filepath.Rel(dc.dir, path)
+		if err != nil {
+			return nil
+		}
+		// 只索引 <分区>/<key前两位>/<key> 结构的文件，其他文件不属于磁盘缓存
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		if len(parts) != 3 || len(parts[2]) < 2 || parts[1] != parts[2][:2] {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		files = append(files, found{key: parts[0] + "/" + parts[2], size: info.Size(), modTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("扫描缓存目录失败: %v", err)
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	for _, f := range files {
+		dc.items[f.key] = dc.lru.PushFront(&diskCacheEntry{key: f.key, size: f.size})
+		dc.currentSize += f.size
+	}
+	dc.evictLocked()
+
+	log.Printf("✅ 磁盘缓存索引重建完成: %s, %d 个文件, %d 字节", dc.dir, len(dc.items), dc.currentSize)
+	return nil
+}
+
+// 键的格式为 分区/名称
+func (dc *DiskCache) path(key string) string {
+	space, name := path.Split(key)
+	return filepath.Join(dc.dir, space, name[:2], name)
+}
+
+// 读取缓存，命中时将条目移到最近使用位置
+func (dc *DiskCache) Get(key string) ([]byte, bool) {
+	dc.mu.Lock()
+	elem, ok := dc.items[key]
+	var gen uint64
+	if ok {
+		dc.lru.MoveToFront(elem)
+		gen = elem.Value.(*diskCacheEntry).gen
+	}
+	dc.mu.Unlock()
+
+	if !ok {
+		dc.misses.Add(1)
+		return nil, false
+	}
+
+	data, err := os.ReadFile(dc.path(key))
+	if err != nil {
+		// 文件被外部删除或损坏，移除索引；读取期间条目已被并发写入替换时保留新条目
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("读取磁盘缓存失败: %v", err)
+		}
+		dc.mu.Lock()
+		if cur, ok := dc.items[key]; ok && cur == elem && cur.Value.(*diskCacheEntry).gen == gen {
+			dc.removeLocked(cur)
+		}
+		dc.mu.Unlock()
+		dc.misses.Add(1)
+		return nil, false
+	}
+
+	now := time.Now()
+	os.Chtimes(dc.path(key), now, now)
+	dc.hits.Add(1)
+	return data, true
+}
+
+// 写入缓存，超出 maxSize 时淘汰最久未使用的条目
+func (dc *DiskCache) Put(key string, data []byte) error {
+	size := int64(len(data))
+	if dc.maxSize > 0 && size > dc.maxSize {
+		return fmt.Errorf("缓存条目大小 %d 超过缓存上限 %d", size, dc.maxSize)
+	}
+
+	file := dc.path(key)
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return fmt.Errorf("创建缓存目录失败: %v", err)
+	}
+	// 先写临时文件再重命名，避免并发读取到不完整的文件
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("创建缓存文件失败: %v", err)
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("写入缓存文件失败: %v", err)
+	}
+
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if elem, ok := dc.items[key]; ok {
+		entry := elem.Value.(*diskCacheEntry)
+		dc.currentSize += size - entry.size
+		entry.size = size
+		entry.gen++
+		dc.lru.MoveToFront(elem)
+	} else {
+		dc.items[key] = dc.lru.PushFront(&diskCacheEntry{key: key, size: size})
+		dc.currentSize += size
+	}
+	dc.evictLocked()
+	return nil
+}
+
+// 删除缓存条目
+func (dc *DiskCache) Remove(key string) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if elem, ok := dc.items[key]; ok {
+		dc.removeLocked(elem)
+	}
+}
+
+func (dc *DiskCache) removeLocked(elem *list.Element) {
+	entry := dc.lru.Remove(elem).(*diskCacheEntry)
+	delete(dc.items, entry.key)
+	dc.currentSize -= entry.size
+	if err := os.Remove(dc.path(entry.key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("警告: 无法删除缓存文件 %s: %v", entry.key, err)
+	}
+}
+
+func (dc *DiskCache) evictLocked() {
+	if dc.maxSize <= 0 {
+		return
+	}
+	for dc.currentSize > dc.maxSize {
+		elem := dc.lru.Back()
+		if elem == nil {
+			return
+		}
+		dc.removeLocked(elem)
+		dc.evictions.Add(1)
+	}
+}
+
+// 获取缓存统计信息
+func (dc *DiskCache) Stats() DiskCacheStats {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	return DiskCacheStats{
+		Entries:   len(dc.items),
+		Size:      dc.currentSize,
+		MaxSize:   dc.maxSize,
+		Hits:      dc.hits.Load(),
+		Misses:    dc.misses.Load(),
+		Evictions: dc.evictions.Load(),
+	}
+}
+
+// 磁盘缓存中的一个分区（cacheDir 下的子目录），各分区共享 cacheMaxSize
+type diskCacheSpace struct {
+	cache *DiskCache
+	name  string
+}
+
+var sharedDiskCache *DiskCache
+
+// 打开 cacheDir 下的缓存分区，首次调用时扫描整个 cacheDir 建立共享索引
+func openDiskCacheSpace(name string) (*diskCacheSpace, error) {
+	if sharedDiskCache == nil {
+		dc, err := newDiskCache(config.CacheDir, config.CacheMaxSize)
+		if err != nil {
+			return nil, err
+		}
+		sharedDiskCache = dc
+	}
+	return &diskCacheSpace{cache: sharedDiskCache, name: name}, nil
+}
+
+func (s *diskCacheSpace) Get(key string) ([]byte, bool) {
+	return s.cache.Get(s.name + "/" + key)
+}
+
+func (s *diskCacheSpace) Put(key string, data []byte) error {
+	return s.cache.Put(s.name+"/"+key, data)
+}
+
+func (s *diskCacheSpace) Remove(key string) {
+	s.cache.Remove(s.name + "/" + key)
+}
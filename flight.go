@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+var errFlightPanicked = errors.New("合并执行的调用异常退出")
+
+// 合并相同键的并发调用：同一时刻只有第一个调用真正执行，其余调用等待并共享其结果。
+// 调用结束后立即从表中删除，不会像按标识符缓存互斥锁那样无限增长。
+type flightGroup[T any] struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall[T]
+}
+
+type flightCall[T any] struct {
+	wg  sync.WaitGroup
+	val T
+	err error
+}
+
+// 执行 fn 并返回结果，shared 表示结果是否与其他调用者共享
+func (g *flightGroup[T]) Do(key string, fn func() (T, error)) (v T, err error, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = map[string]*flightCall[T]{}
+	}
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		call.wg.Wait()
+		return call.val, call.err, true
+	}
+	call := &flightCall[T]{}
+	call.wg.Add(1)
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		call.wg.Done()
+	}()
+	call.err = errFlightPanicked
+	call.val, call.err = fn()
+	return call.val, call.err, false
+}
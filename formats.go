@@ -0,0 +1,372 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// 单个输出格式的编码参数，未设置的项使用各格式的默认值
+type EncodingProfile struct {
+	Quality     int    `yaml:"quality" json:"quality,omitempty"`         // jpg/webp/png(调色板)/tif(jpeg压缩)/jp2/avif/heic 的压缩质量
+	Compression string `yaml:"compression" json:"compression,omitempty"` // tif 压缩方式：jpeg | deflate | lzw | zstd | webp | none
+	Lossless    *bool  `yaml:"lossless" json:"lossless,omitempty"`       // webp/jp2/avif/heic 无损压缩
+	Interlace   *bool  `yaml:"interlace" json:"interlace,omitempty"`     // jpg 渐进式（默认开启）/ png 隔行扫描
+	Subsampling string `yaml:"subsampling" json:"subsampling,omitempty"` // jpg/jp2 色度抽样：auto | on | off
+	Effort      int    `yaml:"effort" json:"effort,omitempty"`           // webp(0-6)/gif(1-10)/avif/heic(0-9) 的压缩力度
+	Strip       *bool  `yaml:"strip" json:"strip,omitempty"`             // 去除元数据
+	Palette     *bool  `yaml:"palette" json:"palette,omitempty"`         // png 使用调色板（8位索引色）
+
+	bitonal bool // bitonal 质量的输出，png/tif 按 1 位图像保存
+}
+
+// 按标识符前缀覆盖编码参数
+type EncodingOverride struct {
+	Prefix   string                     `yaml:"prefix"`   // 标识符前缀
+	Encoding map[string]EncodingProfile `yaml:"encoding"` // 键为格式名，只需填写要覆盖的项
+}
+
+// 用 over 中设置了的项覆盖 p
+func (p EncodingProfile) merge(over EncodingProfile) EncodingProfile {
+	if over.Quality > 0 {
+		p.Quality = over.Quality
+	}
+	if over.Compression != "" {
+		p.Compression = over.Compression
+	}
+	if over.Lossless != nil {
+		p.Lossless = over.Lossless
+	}
+	if over.Interlace != nil {
+		p.Interlace = over.Interlace
+	}
+	if over.Subsampling != "" {
+		p.Subsampling = over.Subsampling
+	}
+	if over.Effort > 0 {
+		p.Effort = over.Effort
+	}
+	if over.Strip != nil {
+		p.Strip = over.Strip
+	}
+	if over.Palette != nil {
+		p.Palette = over.Palette
+	}
+	return p
+}
+
+// 编码参数指纹：格式默认值与标识符前缀覆盖合并后的全部参数
+func (p EncodingProfile) fingerprint() string {
+	data, _ := json.Marshal(p)
+	return string(data)
+}
+
+func boolOr(v *bool, def bool) bool {
+	if v != nil {
+		return *v
+	}
+	return def
+}
+
+func subsampleMode(name string) vips.SubsampleMode {
+	switch name {
+	case "on":
+		return vips.VipsForeignSubsampleOn
+	case "off":
+		return vips.VipsForeignSubsampleOff
+	}
+	return vips.VipsForeignSubsampleAuto
+}
+
+// IIIF 输出格式
+type outputFormat struct {
+	Name   string // IIIF URL 中的格式名
+	MIME   string
+	Export func(img *vips.ImageRef, p EncodingProfile) ([]byte, error)
+}
+
+// 服务器实现的全部输出格式，实际可用的格式在启动时检测
+var outputFormats = []outputFormat{
+	{Name: "jpg", MIME: "image/jpeg", Export: exportJpeg},
+	{Name: "png", MIME: "image/png", Export: exportPng},
+	{Name: "webp", MIME: "image/webp", Export: exportWebp},
+	{Name: "gif", MIME: "image/gif", Export: exportGif},
+	{Name: "tif", MIME: "image/tiff", Export: exportTiff},
+	{Name: "jp2", MIME: "image/jp2", Export: exportJp2},
+	{Name: "avif", MIME: "image/avif", Export: exportAvif},
+	{Name: "heic", MIME: "image/heic", Export: exportHeif},
+}
+
+// 启动时检测到的可用格式，nil 表示尚未检测
+var availableFormats map[string]bool
+
+// 用一张小图依次尝试各格式的导出，记录当前链接的 libvips 实际支持的格式，必须在 vips.Startup 之后调用
+func detectOutputFormats() {
+	img, err := vips.Black(8, 8)
+	if err != nil {
+		log.Printf("警告: 无法检测输出格式支持: %v", err)
+		return
+	}
+	defer img.Close()
+
+	availableFormats = map[string]bool{}
+	var names []string
+	for _, f := range outputFormats {
+		probe, err := img.Copy()
+		if err != nil {
+			continue
+		}
+		_, err = f.Export(probe, encodingProfile("", f.Name))
+		probe.Close()
+		if err != nil {
+			log.Printf("输出格式 %s 不可用: %v", f.Name, err)
+			continue
+		}
+		availableFormats[f.Name] = true
+		names = append(names, f.Name)
+	}
+	log.Printf("✅ 可用输出格式: %v", names)
+}
+
+// 查找可用的输出格式，jpeg 视为 jpg
+func lookupFormat(name string) (outputFormat, bool) {
+	if name == "jpeg" {
+		name = "jpg"
+	}
+	for _, f := range outputFormats {
+		if f.Name != name {
+			continue
+		}
+		if availableFormats != nil && !availableFormats[name] {
+			return outputFormat{}, false
+		}
+		return f, true
+	}
+	return outputFormat{}, false
+}
+
+// 服务器支持的输出格式
+func supportedFormats() []string {
+	var names []string
+	for _, f := range outputFormats {
+		if _, ok := lookupFormat(f.Name); ok {
+			names = append(names, f.Name)
+		}
+	}
+	return names
+}
+
+// 输出格式的 Content-Type
+func formatMIME(name string) string {
+	if f, ok := lookupFormat(name); ok {
+		return f.MIME
+	}
+	return "application/octet-stream"
+}
+
+// 格式的编码参数：先取 encoding 中的格式默认值，再应用第一个匹配标识符前缀的覆盖
+func encodingProfile(identifier, format string) EncodingProfile {
+	if format == "jpeg" {
+		format = "jpg"
+	}
+	profile := config.Encoding[format]
+	identifier = strings.Trim(identifier, "/")
+	for _, o := range config.EncodingOverrides {
+		if matchPathPrefix(identifier, o.Prefix) {
+			if over, ok := o.Encoding[format]; ok {
+				profile = profile.merge(over)
+			}
+			break
+		}
+	}
+	return profile
+}
+
+// 前缀按完整路径段匹配：archive/ 匹配 archive 和 archive/a.jpg，不匹配 archive2/a.jpg；空前缀匹配所有标识符
+func matchPathPrefix(identifier, prefix string) bool {
+	prefix = strings.Trim(prefix, "/")
+	return prefix == "" || identifier == prefix || strings.HasPrefix(identifier, prefix+"/")
+}
+
+// 按请求的格式和标识符对应的编码参数导出图像
+func exportImage(img *vips.ImageRef, req IIIFRequest) ([]byte, error) {
+	f, ok := lookupFormat(req.Format)
+	if !ok {
+		return nil, fmt.Errorf("unsupported format: %s", req.Format)
+	}
+	profile := encodingProfile(req.Identifier, f.Name)
+	profile.bitonal = req.Quality == "bitonal" && img.Bands() == 1 && img.BandFormat() == vips.BandFormatUchar
+	return f.Export(img, profile)
+}
+
+func orDefaultInt(v, def int) int {
+	if v > 0 {
+		return v
+	}
+	return def
+}
+
+func exportJpeg(img *vips.ImageRef, p EncodingProfile) ([]byte, error) {
+	params := vips.NewJpegExportParams()
+	params.Quality = orDefaultInt(p.Quality, 85)
+	params.Interlace = boolOr(p.Interlace, true)
+	params.SubsampleMode = subsampleMode(p.Subsampling)
+	params.StripMetadata = boolOr(p.Strip, false)
+	data, _, err := img.ExportJpeg(params)
+	return data, err
+}
+
+func exportPng(img *vips.ImageRef, p EncodingProfile) ([]byte, error) {
+	params := vips.NewPngExportParams()
+	params.Interlace = boolOr(p.Interlace, false)
+	params.Palette = boolOr(p.Palette, false)
+	if p.Quality > 0 {
+		params.Quality = p.Quality
+	}
+	params.StripMetadata = boolOr(p.Strip, false)
+	if p.bitonal {
+		params.Palette = false
+		params.Bitdepth = 1
+	}
+	data, _, err := img.ExportPng(params)
+	return data, err
+}
+
+func exportWebp(img *vips.ImageRef, p EncodingProfile) ([]byte, error) {
+	params := vips.NewWebpExportParams()
+	if p.Quality > 0 {
+		params.Quality = p.Quality
+	}
+	params.Lossless = boolOr(p.Lossless, false)
+	if p.Effort > 0 {
+		params.ReductionEffort = p.Effort
+	}
+	params.StripMetadata = boolOr(p.Strip, false)
+	data, _, err := img.ExportWebp(params)
+	return data, err
+}
+
+func exportGif(img *vips.ImageRef, p EncodingProfile) ([]byte, error) {
+	params := vips.NewGifExportParams()
+	if p.Quality > 0 {
+		params.Quality = p.Quality
+	}
+	if p.Effort > 0 {
+		params.Effort = p.Effort
+	}
+	params.StripMetadata = boolOr(p.Strip, false)
+	data, _, err := img.ExportGIF(params)
+	return data, err
+}
+
+// TIFF 默认使用 JPEG 压缩；带透明通道或非 8 位图像无法使用 JPEG 压缩，改用 deflate
+func exportTiff(img *vips.ImageRef, p EncodingProfile) ([]byte, error) {
+	params := vips.NewTiffExportParams()
+	params.Quality = orDefaultInt(p.Quality, 85)
+	params.Compression, _ = parseTiffCompression(p.Compression)
+	if params.Compression == vips.TiffCompressionJpeg &&
+		(img.HasAlpha() || img.BandFormat() != vips.BandFormatUchar) {
+		params.Compression = vips.TiffCompressionDeflate
+	}
+	// bitonal 图像使用 CCITT Group 4 压缩，libvips 会按 1 位保存
+	if p.bitonal {
+		params.Compression = vips.TiffCompressionFax4
+	}
+	params.StripMetadata = boolOr(p.Strip, false)
+	data, _, err := img.ExportTiff(params)
+	return data, err
+}
+
+func exportJp2(img *vips.ImageRef, p EncodingProfile) ([]byte, error) {
+	if err := stripIfRequested(img, p); err != nil {
+		return nil, err
+	}
+	params := vips.NewJp2kExportParams()
+	params.Quality = orDefaultInt(p.Quality, 80)
+	params.Lossless = boolOr(p.Lossless, false)
+	params.SubsampleMode = subsampleMode(p.Subsampling)
+	data, _, err := img.ExportJp2k(params)
+	return data, err
+}
+
+func exportAvif(img *vips.ImageRef, p EncodingProfile) ([]byte, error) {
+	params := vips.NewAvifExportParams()
+	if p.Quality > 0 {
+		params.Quality = p.Quality
+	}
+	params.Lossless = boolOr(p.Lossless, false)
+	if p.Effort > 0 {
+		params.Effort = p.Effort
+	}
+	params.StripMetadata = boolOr(p.Strip, false)
+	data, _, err := img.ExportAvif(params)
+	return data, err
+}
+
+func exportHeif(img *vips.ImageRef, p EncodingProfile) ([]byte, error) {
+	if err := stripIfRequested(img, p); err != nil {
+		return nil, err
+	}
+	params := vips.NewHeifExportParams()
+	if p.Quality > 0 {
+		params.Quality = p.Quality
+	}
+	params.Lossless = boolOr(p.Lossless, false)
+	if p.Effort > 0 {
+		params.Effort = p.Effort
+	}
+	data, _, err := img.ExportHeif(params)
+	return data, err
+}
+
+// jp2/heic 的导出参数没有 strip 选项，需要时在导出前去除图像的元数据和 ICC profile
+func stripIfRequested(img *vips.ImageRef, p EncodingProfile) error {
+	if !boolOr(p.Strip, false) {
+		return nil
+	}
+	if err := img.RemoveMetadata(); err != nil {
+		return err
+	}
+	return img.RemoveICCProfile()
+}
+
+// 检查编码配置：tif 和金字塔TIFF的压缩方式（含各前缀覆盖）必须是已知名称
+func validateEncodingConfig() error {
+	check := func(field, name string) error {
+		if _, ok := parseTiffCompression(name); !ok {
+			return fmt.Errorf("%s: 未知的压缩方式 %q", field, name)
+		}
+		return nil
+	}
+	if err := check("encoding.tif.compression", config.Encoding["tif"].Compression); err != nil {
+		return err
+	}
+	for i, o := range config.EncodingOverrides {
+		if err := check(fmt.Sprintf("encodingOverrides[%d].encoding.tif.compression", i), o.Encoding["tif"].Compression); err != nil {
+			return err
+		}
+	}
+	return check("pyramid.compression", config.Pyramid.Compression)
+}
+
+// 解析 TIFF 压缩方式名称，空字符串和未知名称返回 jpeg（未知名称在启动时由 validateEncodingConfig 拒绝）
+func parseTiffCompression(name string) (vips.TiffCompression, bool) {
+	switch name {
+	case "", "jpeg":
+		return vips.TiffCompressionJpeg, true
+	case "deflate":
+		return vips.TiffCompressionDeflate, true
+	case "lzw":
+		return vips.TiffCompressionLzw, true
+	case "zstd":
+		return vips.TiffCompressionZstd, true
+	case "webp":
+		return vips.TiffCompressionWebp, true
+	case "none":
+		return vips.TiffCompressionNone, true
+	}
+	return vips.TiffCompressionJpeg, false
+}
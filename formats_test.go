@@ -0,0 +1,60 @@
+package main
+
+import "testing"
+
+func TestEncodingOverridePrefix(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config.Encoding = map[string]EncodingProfile{"jpg": {Quality: 85}}
+	config.EncodingOverrides = []EncodingOverride{
+		{Prefix: "/archive/", Encoding: map[string]EncodingProfile{"jpg": {Quality: 95}}},
+		{Prefix: "scans/raw", Encoding: map[string]EncodingProfile{"jpg": {Quality: 90}}},
+	}
+
+	tests := []struct {
+		identifier string
+		quality    int
+	}{
+		{"archive/a.jpg", 95},
+		{"/archive/sub/a.jpg", 95},
+		{"archive", 95},
+		{"archive2/a.jpg", 85},
+		{"archived.jpg", 85},
+		{"scans/raw/a.tif", 90},
+		{"scans/raw2/a.tif", 85},
+		{"scans/rawfile.tif", 85},
+		{"other.jpg", 85},
+	}
+	for _, tt := range tests {
+		if got := encodingProfile(tt.identifier, "jpeg").Quality; got != tt.quality {
+			t.Errorf("%s: quality=%d，期望 %d", tt.identifier, got, tt.quality)
+		}
+	}
+}
+
+func TestValidateEncodingConfig(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+
+	tests := []struct {
+		name      string
+		encoding  map[string]EncodingProfile
+		overrides []EncodingOverride
+		pyramid   string
+		ok        bool
+	}{
+		{name: "默认", ok: true},
+		{name: "已知压缩方式", encoding: map[string]EncodingProfile{"tif": {Compression: "lzw"}}, pyramid: "zstd", ok: true},
+		{name: "未知 tif 压缩", encoding: map[string]EncodingProfile{"tif": {Compression: "lzma"}}},
+		{name: "未知覆盖压缩", overrides: []EncodingOverride{
+			{Prefix: "archive/", Encoding: map[string]EncodingProfile{"tif": {Compression: "jpg"}}},
+		}},
+		{name: "未知金字塔压缩", pyramid: "deflat"},
+	}
+	for _, tt := range tests {
+		config.Encoding, config.EncodingOverrides, config.Pyramid.Compression = tt.encoding, tt.overrides, tt.pyramid
+		if err := validateEncodingConfig(); (err == nil) != tt.ok {
+			t.Errorf("%s: err=%v", tt.name, err)
+		}
+	}
+}
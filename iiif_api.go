@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// IIIF 路由配置：每个路由前缀使用一个 Image API 版本
+type RouteConfig struct {
+	Path string `yaml:"path"` // 路由前缀，如 /iiif/3
+	API  string `yaml:"api"`  // Image API 版本：3（默认）或 2（2.1）
+}
+
+// 已注册的 IIIF 路由
+type iiifRoute struct {
+	Path string
+	API  int // 2 或 3
+}
+
+var (
+	// IIIF 3.0 图像请求
+	iiifRegex = regexp.MustCompile(
+		`^(.*?)/` + // identifier (group 1)
+			`(full|square|\d+,\d+,\d+,\d+|pct:\d+(?:\.\d+)?,\d+(?:\.\d+)?,\d+(?:\.\d+)?,\d+(?:\.\d+)?)/` + // region (group 2)
+			`(\^?(?:full|max|\d+,|,\d+|!?\d+,\d+|pct:\d+(?:\.\d+)?))/` + // size (group 3)
+			`(!?\d+(?:\.\d+)?)/` + // rotation (group 4)
+			`(default|color|gray|bitonal)\.` + // quality (group 5)
+			`([a-z0-9]+)$`, // format (group 6)，是否支持由 isValidFormat 判断
+	)
+
+	// IIIF 2.1 图像请求：没有 ^ 前缀，额外接受 native 质量
+	iiif2Regex = regexp.MustCompile(
+		`^(.*?)/` +
+			`(full|square|\d+,\d+,\d+,\d+|pct:\d+(?:\.\d+)?,\d+(?:\.\d+)?,\d+(?:\.\d+)?,\d+(?:\.\d+)?)/` +
+			`(full|max|\d+,|,\d+|!?\d+,\d+|pct:\d+(?:\.\d+)?)/` +
+			`(!?\d+(?:\.\d+)?)/` +
+			`(default|color|gray|bitonal|native)\.` +
+			`([a-z0-9]+)$`,
+	)
+)
+
+// 由配置得到 IIIF 路由，未配置时只注册 /iiif/{version} 的 3.0 路由
+func configRoutes() ([]iiifRoute, error) {
+	if len(config.Routes) == 0 {
+		return []iiifRoute{{Path: "/iiif/" + config.Version, API: 3}}, nil
+	}
+
+	var routes []iiifRoute
+	for _, rc := range config.Routes {
+		path := "/" + strings.Trim(rc.Path, "/")
+		if path == "/" {
+			return nil, fmt.Errorf("路由前缀不能为空")
+		}
+		var api int
+		switch rc.API {
+		case "", "3", "3.0":
+			api = 3
+		case "2", "2.1":
+			api = 2
+		default:
+			return nil, fmt.Errorf("路由 %s 的 API 版本无效: %q", path, rc.API)
+		}
+		routes = append(routes, iiifRoute{Path: path, API: api})
+	}
+	return routes, nil
+}
+
+// 按路由的 API 版本解析图像请求，统一转换为内部使用的 3.0 语义
+func (rt iiifRoute) parseImageRequest(path string) (IIIFRequest, bool) {
+	re := iiifRegex
+	if rt.API == 2 {
+		re = iiif2Regex
+	}
+	matches := re.FindStringSubmatch(path)
+	if matches == nil {
+		return IIIFRequest{}, false
+	}
+	req := IIIFRequest{
+		Identifier: matches[1],
+		Region:     matches[2],
+		Size:       matches[3],
+		Rotation:   matches[4],
+		Quality:    matches[5],
+		Format:     matches[6],
+	}
+	if rt.API == 2 {
+		req = convertV2Request(req)
+	}
+	return req, true
+}
+
+// 2.1 语法转换为 3.0：2.1 允许放大（sizeAboveFull），对应 3.0 的 ^ 前缀；native 即 default
+func convertV2Request(req IIIFRequest) IIIFRequest {
+	switch req.Size {
+	case "full", "max":
+	default:
+		req.Size = "^" + req.Size
+	}
+	if req.Quality == "native" {
+		req.Quality = "default"
+	}
+	return req
+}
+
+// 已注册的 IIIF 路由，第一个用于首页示例
+var iiifRoutes []iiifRoute
+
+// 客户端可访问的路由前缀，如 https://images.example.org/iiif/3
+func (rt iiifRoute) baseURL(r *http.Request) string {
+	return requestBaseURL(r) + rt.Path
+}
+
+// info.json 中的图像服务 id，标识符中的 / 按规范编码为 %2F
+func (rt iiifRoute) serviceID(r *http.Request, identifier string) string {
+	return rt.baseURL(r) + "/" + url.PathEscape(strings.Trim(identifier, "/"))
+}
+
+// IIIF 信息响应 (v2.1)
+type IIIFInfo2 struct {
+	Context  string        `json:"@context"`
+	ID       string        `json:"@id"`
+	Protocol string        `json:"protocol"`
+	Width    int           `json:"width"`
+	Height   int           `json:"height"`
+	Sizes    []Size        `json:"sizes,omitempty"`
+	Tiles    []Tile        `json:"tiles,omitempty"`
+	Profile  []interface{} `json:"profile"`
+}
+
+// 2.1 profile 数组中描述额外能力的对象
+type IIIFProfile2 struct {
+	Formats   []string `json:"formats,omitempty"`
+	Qualities []string `json:"qualities,omitempty"`
+	Supports  []string `json:"supports,omitempty"`
+	MaxWidth  int      `json:"maxWidth,omitempty"`
+	MaxHeight int      `json:"maxHeight,omitempty"`
+	MaxArea   int64    `json:"maxArea,omitempty"`
+}
+
+// 将 3.0 info.json 转换为 2.1 格式
+func convertInfoV2(info IIIFInfo) IIIFInfo2 {
+	return IIIFInfo2{
+		Context:  "http://iiif.io/api/image/2/context.json",
+		ID:       info.ID,
+		Protocol: info.Protocol,
+		Width:    info.Width,
+		Height:   info.Height,
+		Sizes:    info.Sizes,
+		Tiles:    info.Tiles,
+		Profile: []interface{}{
+			"http://iiif.io/api/image/2/level2.json",
+			IIIFProfile2{
+				Formats:   info.ExtraFormats,
+				Qualities: append([]string{"native"}, supportedQualities()...),
+				MaxWidth:  info.MaxWidth,
+				MaxHeight: info.MaxHeight,
+				MaxArea:   info.MaxArea,
+				Supports: []string{
+					"baseUriRedirect",
+					"canonicalLinkHeader",
+					"jsonldMediaType",
+					"profileLinkHeader",
+					"regionByPct",
+					"regionByPx",
+					"regionSquare",
+					"sizeAboveFull",
+					"sizeByConfinedWh",
+					"sizeByDistortedWh",
+					"sizeByH",
+					"sizeByPct",
+					"sizeByW",
+					"sizeByWh",
+					"rotationBy90s",
+					"rotationArbitrary",
+					"mirroring",
+					"cors",
+				},
+			},
+		},
+	}
+}
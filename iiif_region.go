@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// 解析后的 IIIF Image API 3.0 region 参数
+//
+//	full  square  x,y,w,h  pct:x,y,w,h
+type regionSpec struct {
+	Full   bool
+	Square bool
+	Pct    bool       // 百分比区域，值可为小数
+	Values [4]float64 // x, y, w, h
+}
+
+var errRegionOutside = errors.New("区域完全位于图像之外")
+
+// 解析 region 参数
+func parseRegion(region string) (regionSpec, error) {
+	var spec regionSpec
+	switch region {
+	case "full":
+		spec.Full = true
+		return spec, nil
+	case "square":
+		spec.Square = true
+		return spec, nil
+	}
+
+	s := region
+	if strings.HasPrefix(s, "pct:") {
+		spec.Pct = true
+		s = s[4:]
+	}
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return spec, fmt.Errorf("区域格式无效: %s", region)
+	}
+	for i, part := range parts {
+		var v float64
+		var err error
+		if spec.Pct {
+			v, err = strconv.ParseFloat(part, 64)
+			if err == nil && (math.IsNaN(v) || math.IsInf(v, 0)) {
+				err = strconv.ErrSyntax
+			}
+		} else {
+			var n int
+			n, err = strconv.Atoi(part)
+			v = float64(n)
+		}
+		if err != nil || v < 0 {
+			return spec, fmt.Errorf("区域值无效: %s", region)
+		}
+		spec.Values[i] = v
+	}
+	if spec.Values[2] <= 0 || spec.Values[3] <= 0 {
+		return spec, fmt.Errorf("区域宽高必须大于0: %s", region)
+	}
+	return spec, nil
+}
+
+// 计算原图坐标下的区域：部分超出图像的区域裁剪到图像边界，完全在图像之外时返回错误
+func (spec regionSpec) resolve(width, height int) (x, y, w, h int, err error) {
+	if width <= 0 || height <= 0 {
+		return 0, 0, 0, 0, errors.New("图像尺寸无效")
+	}
+
+	switch {
+	case spec.Full:
+		return 0, 0, width, height, nil
+
+	case spec.Square:
+		if width > height {
+			return (width - height) / 2, 0, height, height, nil
+		}
+		return 0, (height - width) / 2, width, width, nil
+
+	case spec.Pct:
+		// 左上角向下取整，否则靠近右下边缘的区域（如 100 像素上的 pct:99.6,...）会被舍入到图像之外
+		x = int(math.Floor(float64(width) * spec.Values[0] / 100))
+		y = int(math.Floor(float64(height) * spec.Values[1] / 100))
+		// 宽高按右下角换算，避免舍入误差导致相邻区域出现缝隙
+		w = int(math.Round(float64(width)*(spec.Values[0]+spec.Values[2])/100)) - x
+		h = int(math.Round(float64(height)*(spec.Values[1]+spec.Values[3])/100)) - y
+		if w < 1 {
+			w = 1
+		}
+		if h < 1 {
+			h = 1
+		}
+
+	default:
+		x, y = int(spec.Values[0]), int(spec.Values[1])
+		w, h = int(spec.Values[2]), int(spec.Values[3])
+	}
+
+	if x >= width || y >= height {
+		return 0, 0, 0, 0, fmt.Errorf("%w: x=%d, y=%d (图像尺寸: %dx%d)", errRegionOutside, x, y, width, height)
+	}
+	if x+w > width {
+		w = width - x
+	}
+	if y+h > height {
+		h = height - y
+	}
+	return x, y, w, h, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseRegionInvalid(t *testing.T) {
+	for _, region := range []string{
+		"", "squares", "1,2,3", "1,2,3,4,5", "a,b,c,d", "-1,0,10,10", "0,0,0,10", "0,0,10,0",
+		"1.5,0,10,10", "pct:", "pct:0,0,0,1", "pct:-1,0,10,10", "pct:NaN,0,1,1", "pct:0,0,Inf,1",
+	} {
+		if _, err := parseRegion(region); err == nil {
+			t.Errorf("parseRegion(%q) 应返回错误", region)
+		}
+	}
+}
+
+func TestRegionResolve(t *testing.T) {
+	tests := []struct {
+		region        string
+		width, height int
+		x, y, w, h    int
+		outside       bool // 完全在图像之外，由 renderImage 返回 400
+	}{
+		{region: "full", width: 100, height: 80, x: 0, y: 0, w: 100, h: 80},
+		{region: "square", width: 100, height: 80, x: 10, y: 0, w: 80, h: 80},
+		{region: "square", width: 80, height: 100, x: 0, y: 10, w: 80, h: 80},
+		{region: "10,20,30,40", width: 100, height: 80, x: 10, y: 20, w: 30, h: 40},
+		{region: "0,0,100,80", width: 100, height: 80, x: 0, y: 0, w: 100, h: 80},
+
+		// 部分超出图像：裁剪到边界
+		{region: "90,70,30,30", width: 100, height: 80, x: 90, y: 70, w: 10, h: 10},
+		{region: "0,0,500,500", width: 100, height: 80, x: 0, y: 0, w: 100, h: 80},
+		{region: "99,79,10,10", width: 100, height: 80, x: 99, y: 79, w: 1, h: 1},
+
+		// 完全在图像之外
+		{region: "100,0,10,10", width: 100, height: 80, outside: true},
+		{region: "0,80,10,10", width: 100, height: 80, outside: true},
+		{region: "200,200,10,10", width: 100, height: 80, outside: true},
+
+		// 百分比，含小数
+		{region: "pct:10,25,50,50", width: 100, height: 80, x: 10, y: 20, w: 50, h: 40},
+		{region: "pct:12.5,12.5,25,25", width: 100, height: 80, x: 12, y: 10, w: 26, h: 20},
+		{region: "pct:0.1,0.1,0.1,0.1", width: 100, height: 80, x: 0, y: 0, w: 1, h: 1},
+		{region: "pct:99.6,0,1,1", width: 100, height: 100, x: 99, y: 0, w: 1, h: 1},
+		{region: "pct:0,99.9,100,5", width: 100, height: 100, x: 0, y: 99, w: 100, h: 1},
+		{region: "pct:33.3,33.3,33.3,33.3", width: 1000, height: 1000, x: 333, y: 333, w: 333, h: 333},
+		{region: "pct:50,50,60,60", width: 100, height: 80, x: 50, y: 40, w: 50, h: 40},
+		{region: "pct:100,0,10,10", width: 100, height: 80, outside: true},
+		{region: "pct:0,150,10,10", width: 100, height: 80, outside: true},
+	}
+
+	for _, tt := range tests {
+		spec, err := parseRegion(tt.region)
+		if err != nil {
+			t.Errorf("%s: 解析失败: %v", tt.region, err)
+			continue
+		}
+		x, y, w, h, err := spec.resolve(tt.width, tt.height)
+		if tt.outside {
+			if !errors.Is(err, errRegionOutside) {
+				t.Errorf("%s (%dx%d): 期望区域在图像之外，得到 %v", tt.region, tt.width, tt.height, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s (%dx%d): 意外错误: %v", tt.region, tt.width, tt.height, err)
+			continue
+		}
+		if x != tt.x || y != tt.y || w != tt.w || h != tt.h {
+			t.Errorf("%s (%dx%d): 得到 %d,%d,%d,%d，期望 %d,%d,%d,%d",
+				tt.region, tt.width, tt.height, x, y, w, h, tt.x, tt.y, tt.w, tt.h)
+		}
+	}
+}
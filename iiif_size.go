@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// 解析后的 IIIF Image API 3.0 size 参数
+//
+//	max  ^max  w,  ^w,  ,h  ^,h  pct:n  ^pct:n  w,h  ^w,h  !w,h  ^!w,h
+type sizeSpec struct {
+	Upscale  bool    // ^ 前缀：允许放大
+	Max      bool    // max
+	Full     bool    // full (2.x)：区域原始尺寸，超出限制时报错
+	Pct      float64 // pct:n 中的 n，0 表示不是百分比
+	W, H     int     // 请求的宽高，0 表示未指定
+	Confined bool    // ! 前缀：保持宽高比缩放到 w,h 范围内
+}
+
+// 服务器尺寸限制，0 表示不限制
+type sizeLimits struct {
+	MaxWidth  int
+	MaxHeight int
+	MaxArea   int64
+}
+
+// 由配置得到尺寸限制：maxArea 即 maxPixels；与 info.json 语义一致，只配置 maxWidth 时 maxHeight 等于 maxWidth
+func configSizeLimits() sizeLimits {
+	limits := sizeLimits{
+		MaxWidth:  config.MaxWidth,
+		MaxHeight: config.MaxHeight,
+		MaxArea:   int64(config.MaxPixels),
+	}
+	if limits.MaxWidth > 0 && limits.MaxHeight <= 0 {
+		limits.MaxHeight = limits.MaxWidth
+	}
+	return limits
+}
+
+var errUpscaleNotAllowed = errors.New("请求尺寸大于区域尺寸，放大需使用 ^ 前缀")
+
+// 解析 size 参数，同时兼容 2.x 的 "full"
+func parseSize(size string) (sizeSpec, error) {
+	var spec sizeSpec
+	s := size
+	if strings.HasPrefix(s, "^") {
+		spec.Upscale = true
+		s = s[1:]
+	}
+
+	switch {
+	case s == "max":
+		spec.Max = true
+		return spec, nil
+
+	case s == "full" && !spec.Upscale:
+		spec.Full = true
+		return spec, nil
+
+	case strings.HasPrefix(s, "pct:"):
+		n, err := strconv.ParseFloat(s[4:], 64)
+		if err != nil || math.IsNaN(n) || math.IsInf(n, 0) || n <= 0 {
+			return spec, fmt.Errorf("尺寸百分比值无效: %s", size)
+		}
+		if n > 100 && !spec.Upscale {
+			return spec, errUpscaleNotAllowed
+		}
+		spec.Pct = n
+		return spec, nil
+	}
+
+	if strings.HasPrefix(s, "!") {
+		spec.Confined = true
+		s = s[1:]
+	}
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return spec, fmt.Errorf("尺寸格式无效: %s", size)
+	}
+
+	var err error
+	if parts[0] != "" {
+		if spec.W, err = parsePositiveInt(parts[0]); err != nil {
+			return spec, fmt.Errorf("宽度值无效: %s", size)
+		}
+	}
+	if parts[1] != "" {
+		if spec.H, err = parsePositiveInt(parts[1]); err != nil {
+			return spec, fmt.Errorf("高度值无效: %s", size)
+		}
+	}
+	if spec.W == 0 && spec.H == 0 {
+		return spec, fmt.Errorf("尺寸格式无效: %s", size)
+	}
+	if spec.Confined && (spec.W == 0 || spec.H == 0) {
+		return spec, fmt.Errorf("!w,h 必须同时指定宽和高: %s", size)
+	}
+	return spec, nil
+}
+
+func parsePositiveInt(s string) (int, error) {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return 0, strconv.ErrSyntax
+		}
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	if n <= 0 {
+		return 0, strconv.ErrRange
+	}
+	return n, nil
+}
+
+// 区域在限制内允许的最大缩放比例，不限制时返回 +Inf
+func (l sizeLimits) maxScale(regionW, regionH int) float64 {
+	scale := math.Inf(1)
+	if l.MaxWidth > 0 {
+		scale = math.Min(scale, float64(l.MaxWidth)/float64(regionW))
+	}
+	if l.MaxHeight > 0 {
+		scale = math.Min(scale, float64(l.MaxHeight)/float64(regionH))
+	}
+	if l.MaxArea > 0 {
+		scale = math.Min(scale, math.Sqrt(float64(l.MaxArea)/(float64(regionW)*float64(regionH))))
+	}
+	return scale
+}
+
+// 检查输出尺寸是否超出服务器限制
+func (l sizeLimits) check(w, h int) error {
+	if (l.MaxWidth > 0 && w > l.MaxWidth) || (l.MaxHeight > 0 && h > l.MaxHeight) ||
+		(l.MaxArea > 0 && int64(w)*int64(h) > l.MaxArea) {
+		return fmt.Errorf("请求的尺寸 %dx%d 超过服务器限制 (maxWidth=%d, maxHeight=%d, maxArea=%d)",
+			w, h, l.MaxWidth, l.MaxHeight, l.MaxArea)
+	}
+	return nil
+}
+
+// 按比例缩放一边（四舍五入），结果至少为1像素
+func scaleDim(n int, scale float64) int {
+	return int(math.Max(1, math.Round(float64(n)*scale)))
+}
+
+// 按比例缩放一边（向下取整），结果至少为1像素
+func scaleDimFloor(n int, scale float64) int {
+	return int(math.Max(1, math.Floor(float64(n)*scale)))
+}
+
+// 根据区域尺寸和服务器限制计算输出尺寸
+func (spec sizeSpec) resolve(regionW, regionH int, limits sizeLimits) (int, int, error) {
+	if regionW <= 0 || regionH <= 0 {
+		return 0, 0, errors.New("图像尺寸无效")
+	}
+
+	var w, h int
+	switch {
+	case spec.Max:
+		scale := limits.maxScale(regionW, regionH)
+		if !spec.Upscale || math.IsInf(scale, 1) {
+			scale = math.Min(scale, 1)
+		}
+		if scale == 1 {
+			return regionW, regionH, nil
+		}
+		// 向下取整，保证不超过限制
+		return scaleDimFloor(regionW, scale), scaleDimFloor(regionH, scale), nil
+
+	case spec.Full:
+		w, h = regionW, regionH
+
+	case spec.Pct > 0:
+		w = scaleDim(regionW, spec.Pct/100)
+		h = scaleDim(regionH, spec.Pct/100)
+
+	case spec.Confined:
+		scale := math.Min(float64(spec.W)/float64(regionW), float64(spec.H)/float64(regionH))
+		if !spec.Upscale {
+			scale = math.Min(scale, 1)
+		}
+		scale = math.Min(scale, limits.maxScale(regionW, regionH))
+		// 四舍五入后不能超出限定框
+		w = scaleDim(regionW, scale)
+		h = scaleDim(regionH, scale)
+		if w > spec.W {
+			w = spec.W
+		}
+		if h > spec.H {
+			h = spec.H
+		}
+		return w, h, nil
+
+	case spec.W > 0 && spec.H > 0:
+		w, h = spec.W, spec.H
+
+	case spec.W > 0:
+		w = spec.W
+		h = scaleDim(regionH, float64(spec.W)/float64(regionW))
+
+	default:
+		h = spec.H
+		w = scaleDim(regionW, float64(spec.H)/float64(regionH))
+	}
+
+	if !spec.Upscale && (w > regionW || h > regionH) {
+		return 0, 0, errUpscaleNotAllowed
+	}
+	if err := limits.check(w, h); err != nil {
+		return 0, 0, err
+	}
+	return w, h, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseSizeInvalid(t *testing.T) {
+	for _, size := range []string{
+		"", ",", "0,", ",0", "-1,", "1.5,", "abc", "1,2,3", "!500,", "!,500", "^!500,",
+		"pct:", "pct:0", "pct:-1", "pct:abc", "pct:NaN", "^full", "^", "^^max",
+	} {
+		if _, err := parseSize(size); err == nil {
+			t.Errorf("parseSize(%q) 应返回错误", size)
+		}
+	}
+}
+
+// 区域为 1000x500 时各种 size 形式的输出尺寸。放大错误 (errUpscaleNotAllowed) 和超出限制都由 renderImage 返回 400
+func TestSizeResolve(t *testing.T) {
+	const regionW, regionH = 1000, 500
+	tests := []struct {
+		size   string
+		limits sizeLimits
+		w, h   int
+		fail   string // upscale: 未使用 ^ 放大；limit: 超出服务器限制
+	}{
+		{size: "max", w: 1000, h: 500},
+		{size: "^max", w: 1000, h: 500},
+		{size: "full", w: 1000, h: 500},
+		{size: "500,", w: 500, h: 250},
+		{size: "1000,", w: 1000, h: 500},
+		{size: "2000,", fail: "upscale"},
+		{size: "^2000,", w: 2000, h: 1000},
+		{size: ",250", w: 500, h: 250},
+		{size: ",600", fail: "upscale"},
+		{size: "^,1000", w: 2000, h: 1000},
+		{size: "pct:50", w: 500, h: 250},
+		{size: "pct:12.5", w: 125, h: 63},
+		{size: "pct:150", fail: "upscale"},
+		{size: "^pct:150", w: 1500, h: 750},
+		{size: "300,200", w: 300, h: 200},
+		{size: "1200,200", fail: "upscale"},
+		{size: "300,600", fail: "upscale"},
+		{size: "^1200,600", w: 1200, h: 600},
+		{size: "!500,500", w: 500, h: 250},
+		{size: "!2000,2000", w: 1000, h: 500},
+		{size: "!300,100", w: 200, h: 100},
+		{size: "^!2000,2000", w: 2000, h: 1000},
+		{size: "^!300,100", w: 200, h: 100},
+
+		// maxWidth / maxHeight / maxArea
+		{size: "max", limits: sizeLimits{MaxWidth: 400}, w: 400, h: 200},
+		{size: "max", limits: sizeLimits{MaxHeight: 100}, w: 200, h: 100},
+		{size: "max", limits: sizeLimits{MaxArea: 125000}, w: 500, h: 250},
+		{size: "max", limits: sizeLimits{MaxArea: 100000}, w: 447, h: 223},
+		{size: "^max", limits: sizeLimits{MaxWidth: 2000, MaxHeight: 2000}, w: 2000, h: 1000},
+		{size: "^max", limits: sizeLimits{MaxArea: 2000000}, w: 2000, h: 1000},
+		{size: "^max", limits: sizeLimits{MaxWidth: 3000, MaxHeight: 1200}, w: 2400, h: 1200},
+		{size: "full", limits: sizeLimits{MaxWidth: 400}, fail: "limit"},
+		{size: "600,", limits: sizeLimits{MaxWidth: 500}, fail: "limit"},
+		{size: ",400", limits: sizeLimits{MaxHeight: 300}, fail: "limit"},
+		{size: "pct:80", limits: sizeLimits{MaxArea: 100000}, fail: "limit"},
+		{size: "^2000,", limits: sizeLimits{MaxArea: 1000000}, fail: "limit"},
+		{size: "!800,800", limits: sizeLimits{MaxWidth: 400}, w: 400, h: 200},
+		{size: "^!2000,2000", limits: sizeLimits{MaxWidth: 1500}, w: 1500, h: 750},
+		{size: "^!2000,2000", limits: sizeLimits{MaxArea: 125000}, w: 500, h: 250},
+	}
+
+	for _, tt := range tests {
+		spec, err := parseSize(tt.size)
+		if err == nil {
+			var w, h int
+			w, h, err = spec.resolve(regionW, regionH, tt.limits)
+			if err == nil && (w != tt.w || h != tt.h) {
+				t.Errorf("%s %+v: 得到 %dx%d，期望 %dx%d", tt.size, tt.limits, w, h, tt.w, tt.h)
+			}
+		}
+		switch tt.fail {
+		case "":
+			if err != nil {
+				t.Errorf("%s %+v: 意外错误: %v", tt.size, tt.limits, err)
+			}
+		case "upscale":
+			if !errors.Is(err, errUpscaleNotAllowed) {
+				t.Errorf("%s %+v: 期望放大错误，得到 %v", tt.size, tt.limits, err)
+			}
+		case "limit":
+			if err == nil || errors.Is(err, errUpscaleNotAllowed) {
+				t.Errorf("%s %+v: 期望超出限制错误，得到 %v", tt.size, tt.limits, err)
+			}
+		}
+	}
+}
+
+func TestConfigSizeLimits(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+
+	config.MaxWidth, config.MaxHeight, config.MaxPixels = 800, 0, 1000000
+	if got, want := configSizeLimits(), (sizeLimits{MaxWidth: 800, MaxHeight: 800, MaxArea: 1000000}); got != want {
+		t.Errorf("只配置 maxWidth: 得到 %+v，期望 %+v", got, want)
+	}
+	config.MaxWidth, config.MaxHeight, config.MaxPixels = 0, 600, 0
+	if got, want := configSizeLimits(), (sizeLimits{MaxHeight: 600}); got != want {
+		t.Errorf("只配置 maxHeight: 得到 %+v，期望 %+v", got, want)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"sort"
+)
+
+// info.json 配置
+type InfoConfig struct {
+	TileSize int `yaml:"tileSize"` // 建议客户端使用的分块大小，默认512
+}
+
+// Image API 3.0 level2 已包含的格式、质量和功能，info.json 中只列出额外支持的部分
+var (
+	level2Formats   = []string{"jpg", "png"}
+	level2Qualities = []string{"default", "color"}
+)
+
+// 服务器支持的质量
+func supportedQualities() []string {
+	return []string{"default", "color", "gray", "bitonal"}
+}
+
+// 超出 level2 的功能
+func extraFeatures() []string {
+	return []string{
+		"canonicalLinkHeader",
+		"mirroring",
+		"profileLinkHeader",
+		"rotationArbitrary",
+		"sizeUpscaling",
+	}
+}
+
+// 从 all 中去掉 level2 已包含的项
+func without(all, base []string) []string {
+	var extra []string
+	for _, v := range all {
+		found := false
+		for _, b := range base {
+			if v == b {
+				found = true
+				break
+			}
+		}
+		if !found {
+			extra = append(extra, v)
+		}
+	}
+	return extra
+}
+
+func infoTileSize() int {
+	if config.Info.TileSize > 0 {
+		return config.Info.TileSize
+	}
+	return 512
+}
+
+// 分块缩放因子：逐级减半，直到整幅图像能放入单个分块
+func infoScaleFactors(width, height, tileSize int) []int {
+	longest := width
+	if height > longest {
+		longest = height
+	}
+	factors := []int{1}
+	for sf := 1; (longest+sf-1)/sf > tileSize; {
+		sf *= 2
+		factors = append(factors, sf)
+	}
+	return factors
+}
+
+// 推荐尺寸：各缩放因子对应的整图尺寸，不超过服务器限制，按从小到大排列
+func infoSizes(width, height int, factors []int, limits sizeLimits) []Size {
+	var sizes []Size
+	for _, sf := range factors {
+		w, h := (width+sf-1)/sf, (height+sf-1)/sf
+		if limits.check(w, h) != nil {
+			continue
+		}
+		sizes = append(sizes, Size{Width: w, Height: h})
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i].Width < sizes[j].Width })
+	return sizes
+}
+
+// 根据图像尺寸和服务器实际能力生成 info.json
+func buildInfo(id string, width, height int) IIIFInfo {
+	limits := configSizeLimits()
+	tileSize := infoTileSize()
+	factors := infoScaleFactors(width, height, tileSize)
+
+	return IIIFInfo{
+		Context:        "http://iiif.io/api/image/3/context.json",
+		ID:             id,
+		Type:           "ImageService3",
+		Protocol:       "http://iiif.io/api/image",
+		Profile:        "level2",
+		Width:          width,
+		Height:         height,
+		MaxWidth:       limits.MaxWidth,
+		MaxHeight:      limits.MaxHeight,
+		MaxArea:        limits.MaxArea,
+		Sizes:          infoSizes(width, height, factors, limits),
+		Tiles:          []Tile{{Width: tileSize, ScaleFactors: factors}},
+		ExtraFormats:   without(supportedFormats(), level2Formats),
+		ExtraQualities: without(supportedQualities(), level2Qualities),
+		ExtraFeatures:  extraFeatures(),
+	}
+}
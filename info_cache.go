@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// 图像元数据缓存：info.json 只依赖图像尺寸，按原图版本缓存后无需再读取原图
+var infoStore *tieredCache
+
+// 初始化 info.json 元数据缓存。
+// 旧版本原图的条目不会再被访问，Redis层必须过期，否则会一直占用 Redis 内存
+func initInfoCache() error {
+	ic, err := openTieredCache(config.InfoCache, "info.json", "info", "iiif:info:", 7*24*time.Hour)
+	if err != nil {
+		return err
+	}
+	infoStore = ic
+	return nil
+}
+
+// 缓存的元数据结构，字段变化时修改使旧缓存失效
+const infoCacheSchema = "3"
+
+// 由标识符和原图版本生成缓存键，原图 ETag 或修改时间变化后自然失效
+func infoCacheKey(identifier, version string) string {
+	hash := sha256.Sum256([]byte(infoCacheSchema + "\x00" + version + "\x00" + strings.Trim(identifier, "/")))
+	return hex.EncodeToString(hash[:])
+}
+
+// 读取缓存的元数据
+func getCachedDims(key string) (imageDims, bool) {
+	var dims imageDims
+	data, ok := infoStore.Get(key)
+	if !ok || json.Unmarshal(data, &dims) != nil {
+		return imageDims{}, false
+	}
+	return dims, true
+}
+
+// 以 JSON 写入元数据
+func putCachedDims(key string, dims imageDims) {
+	if data, err := json.Marshal(dims); err == nil {
+		infoStore.Put(key, data)
+	}
+}
+
+// 获取图像元数据：先查元数据缓存，未命中时读取原图文件头并写入缓存；相同键的并发请求只读取一次
+func imageDimsFor(identifier string, resolved resolvedImage) (imageDims, error) {
+	return cachedImageDims(identifier, sourceVersion(resolved.Info), func() (imageDims, error) {
+		return loadImageDims(identifier, resolved)
+	})
+}
+
+// 只查元数据缓存，不读取原图；未缓存或未启用元数据缓存时返回 false
+func knownImageDims(identifier, version string) (imageDims, bool) {
+	if infoStore == nil {
+		return imageDims{}, false
+	}
+	return getCachedDims(infoCacheKey(identifier, version))
+}
+
+// 按原图版本缓存元数据，load 在缓存未命中时读取
+func cachedImageDims(identifier, version string, load func() (imageDims, error)) (imageDims, error) {
+	key := infoCacheKey(identifier, version)
+	dims, err, _ := infoFlight.Do(key, func() (imageDims, error) {
+		if infoStore != nil {
+			if dims, ok := getCachedDims(key); ok {
+				return dims, nil
+			}
+		}
+		dims, err := load()
+		if err == nil && infoStore != nil {
+			putCachedDims(key, dims)
+		}
+		return dims, err
+	})
+	return dims, err
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// info.json 的 JSON-LD 上下文
+func (rt iiifRoute) contextURI() string {
+	if rt.API == 2 {
+		return "http://iiif.io/api/image/2/context.json"
+	}
+	return "http://iiif.io/api/image/3/context.json"
+}
+
+// 协商 info.json 的 Content-Type：?format=jsonld|json 优先，其次按 Accept 的 q 值选择
+// application/ld+json（带 profile）或 application/json
+func (rt iiifRoute) negotiateInfoContentType(r *http.Request) string {
+	jsonLD := `application/ld+json;profile="` + rt.contextURI() + `"`
+
+	switch strings.ToLower(r.URL.Query().Get("format")) {
+	case "jsonld", "json-ld", "ld+json", "application/ld+json":
+		return jsonLD
+	case "json", "application/json":
+		return "application/json"
+	}
+
+	qLD, qJSON := -1.0, -1.0
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		switch mediaType {
+		case "application/ld+json":
+			// 指定了其他 profile 时不视为匹配
+			if p, ok := params["profile"]; !ok || p == rt.contextURI() {
+				qLD = max(qLD, q)
+			}
+		case "application/json":
+			qJSON = max(qJSON, q)
+		}
+	}
+	if qLD > 0 && qLD >= qJSON {
+		return jsonLD
+	}
+	return "application/json"
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -10,23 +11,19 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
-	"sort"
+	"regexp"
 	"crypto/sha256"
     "encoding/hex"
-    "math"
-    "regexp"
+    "strconv"
     "net/url"
     "gopkg.in/yaml.v3"
 
     "github.com/go-redis/redis/v8"
 	"github.com/davidbyttow/govips/v2/vips"
 	"github.com/gin-gonic/gin"
-	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
 )
 
 // IIIF 配置
@@ -35,7 +32,9 @@ type Config struct {
 	CacheDir      string     `yaml:"cacheDir"`
 	Host          string     `yaml:"host"`
 	Port          int        `yaml:"port"`
-	MaxPixels     int        `yaml:"maxPixels"`
+	MaxPixels     int        `yaml:"maxPixels"`  // 输出图像最大像素数 (maxArea)
+	MaxWidth      int        `yaml:"maxWidth"`   // 输出图像最大宽度，0 表示不限制
+	MaxHeight     int        `yaml:"maxHeight"`  // 输出图像最大高度，0 表示不限制
 	Concurrency   int        `yaml:"concurrency"`
 	EnableHTTPS   bool       `yaml:"enableHTTPS"`
 	CertFile      string     `yaml:"certFile"`
@@ -46,6 +45,25 @@ type Config struct {
 	ReadMinIO     bool       `yaml:"readMinIO"`
 	Version     string     `yaml:"version"`
 	Redis RedisConfig  `yaml:"redis"`
+	Sources       map[string]SourceConfig `yaml:"sources"`       // 按名称注册的图片源
+	DefaultSource string                  `yaml:"defaultSource"` // 默认图片源名称
+	Resolvers     []ResolverRule          `yaml:"resolvers"`     // 标识符解析链
+	DerivativeCache TieredCacheConfig     `yaml:"derivativeCache"` // 派生图缓存
+	InfoCache     TieredCacheConfig       `yaml:"infoCache"`     // info.json 元数据缓存
+	Pyramid       PyramidConfig           `yaml:"pyramid"`       // 金字塔TIFF转换
+	Processing    ProcessingConfig        `yaml:"processing"`    // 图像处理并发控制
+	Vips          VipsConfig              `yaml:"vips"`          // libvips 运行参数
+	HTTPCache     HTTPCacheConfig         `yaml:"httpCache"`     // HTTP 缓存头
+	Routes        []RouteConfig           `yaml:"routes"`        // IIIF 路由及其 Image API 版本
+	PublicBaseURL string                  `yaml:"publicBaseURL"` // 对外访问的基础地址，如 https://images.example.org
+	TrustedProxies []string               `yaml:"trustedProxies"` // 可信反向代理的 CIDR，信任其转发头
+	Info          InfoConfig              `yaml:"info"`          // info.json
+	Rotation      RotationConfig          `yaml:"rotation"`      // 旋转
+	Bitonal       BitonalConfig           `yaml:"bitonal"`       // bitonal 质量的阈值与抖动
+	Color         ColorConfig             `yaml:"color"`         // ICC 色彩管理
+	Encoding      map[string]EncodingProfile `yaml:"encoding"`   // 各输出格式的编码参数，键为格式名
+	EncodingOverrides []EncodingOverride  `yaml:"encodingOverrides"` // 按标识符前缀覆盖编码参数，第一个匹配的生效
+	FormatNegotiation FormatNegotiationConfig `yaml:"formatNegotiation"` // default 格式按 Accept 头协商
 }
 // CORS 配置
 type CORSConfig struct {
@@ -67,8 +85,6 @@ type RedisConfig struct {
 //缓存管理器
 type CacheManager struct {
     cacheDir string
-//     maxSize  int64 // 最大缓存大小(字节)
-//     currentSize int64 // 当前缓存大小
     mu       sync.Mutex
     redisTTL time.Duration // Redis缓存过期时间
 }
@@ -107,11 +123,14 @@ type IIIFInfo struct {
 	ID             string   `json:"id"`
 	Type           string   `json:"type"`
 	Protocol       string   `json:"protocol"`
+	Profile        string   `json:"profile"`
 	Width          int      `json:"width"`
 	Height         int      `json:"height"`
-	Sizes          []Size   `json:"sizes"`
-	Tiles          []Tile   `json:"tiles"`
-	Profile        []string `json:"profile"`
+	MaxWidth       int      `json:"maxWidth,omitempty"`
+	MaxHeight      int      `json:"maxHeight,omitempty"`
+	MaxArea        int64    `json:"maxArea,omitempty"`
+	Sizes          []Size   `json:"sizes,omitempty"`
+	Tiles          []Tile   `json:"tiles,omitempty"`
 	ExtraFormats   []string `json:"extraFormats,omitempty"`
 	ExtraQualities []string `json:"extraQualities,omitempty"`
 	ExtraFeatures  []string `json:"extraFeatures,omitempty"`
@@ -137,6 +156,8 @@ type ServerStatus struct {
 	MemoryStats   runtime.MemStats `json:"memoryStats"`
 	CacheSize     int            `json:"cacheSize"`
 	ImageCount    int            `json:"imageCount"`
+	DiskCache     *DiskCacheStats `json:"diskCache,omitempty"` // 磁盘缓存统计（cacheDir 下所有分区）
+	Processing    PoolStats      `json:"processing"`          // 图像处理池状态
 }
 
 var (
@@ -144,11 +165,11 @@ var (
 	vipsInit    sync.Once
 	cache       sync.Map
 	startTime   = time.Now()
-	minioClient *minio.Client
 	redisClient *redis.Client
 )
 
-func init() {
+// 加载配置并初始化图片源、缓存等，在 main 中最先调用（测试不依赖配置文件和外部服务）
+func setup() {
     // 加载配置文件（必须存在）
     if err := loadConfig(); err != nil {
         log.Fatalf("加载配置文件失败: %v", err)
@@ -158,23 +179,44 @@ func init() {
     if err := ensureDirectories(); err != nil {
         log.Fatalf("创建必要目录失败: %v", err)
     }
-    // 如果不开启minio就不用初始化redis和minio
+    // 初始化图片源（本地、MinIO等）
+    if err := initSources(); err != nil {
+        log.Fatalf("初始化图片源失败: %v", err)
+    }
+    if err := initResolvers(); err != nil {
+        log.Fatalf("初始化标识符解析链失败: %v", err)
+    }
+    if err := initTrustedProxies(); err != nil {
+        log.Fatalf("初始化可信代理失败: %v", err)
+    }
+    // 如果不开启minio就不用初始化redis
     if config.ReadMinIO{
         // 初始化缓存管理器
         log.Println("初始化函数开始执行")
         initCacheManager()
         log.Println("缓存管理器初始化完成")
-        startCacheCleaner()
-        // 初始化MinIO客户端
-        if err := initMinIO(); err != nil {
-            log.Fatalf("初始化MinIO客户端失败: %v", err)
-        }
 
         // 初始化Redis客户端
         if err := initRedis(); err != nil {
             log.Fatalf("初始化Redis客户端失败: %v", err)
         }
     }
+    if err := initDerivativeCache(); err != nil {
+        log.Fatalf("初始化派生图缓存失败: %v", err)
+    }
+    if err := initInfoCache(); err != nil {
+        log.Fatalf("初始化info.json缓存失败: %v", err)
+    }
+    if err := initBitonal(); err != nil {
+        log.Fatalf("初始化bitonal配置失败: %v", err)
+    }
+    if err := validateEncodingConfig(); err != nil {
+        log.Fatalf("编码配置无效: %v", err)
+    }
+    if err := initColorManagement(); err != nil {
+        log.Fatalf("初始化色彩管理失败: %v", err)
+    }
+    initProcessingPool()
 
 }
 
@@ -203,26 +245,6 @@ func generateCacheKey(identifier string) string {
     return hex.EncodeToString(hash[:])
 }
 
-func startCacheCleaner() {
-    // 创建一个24小时周期的定时器
-    ticker := time.NewTicker(24 * time.Hour)
-    go func() {
-        for range ticker.C {
-            log.Println("开始执行每日缓存清理...")
-            if err := cacheManager.cleanupCache(); err != nil {
-                log.Printf("缓存清理失败: %v", err)
-
-                // 失败后5分钟重试一次
-                time.Sleep(5 * time.Minute)
-                if err := cacheManager.cleanupCache(); err != nil {
-                    log.Printf("缓存清理重试失败: %v", err)
-                }
-            }
-        }
-    }()
-    log.Println("已启动每日缓存清理任务")
-}
-
 // 统一的错误响应函数
 func sendIIIFError(c *gin.Context, statusCode int, errorCode, message string) {
     errResponse := IIIFError{
@@ -232,9 +254,46 @@ func sendIIIFError(c *gin.Context, statusCode int, errorCode, message string) {
     errResponse.Error.Code = errorCode
     errResponse.Error.Message = message
 
+    // 错误响应不携带缓存校验头，避免被当作图片缓存
+    c.Writer.Header().Del("ETag")
+    c.Writer.Header().Del("Last-Modified")
+    c.Writer.Header().Del("Cache-Control")
+    c.Writer.Header().Del("Link")
+
+    // 错误响应始终是 JSON，覆盖之前可能设置的图片或 JSON-LD 类型
+    c.Header("Content-Type", "application/json; charset=utf-8")
     c.JSON(statusCode, errResponse)
 }
 
+// 带HTTP状态码和IIIF错误码的错误（合并执行的请求需要把错误类型传给所有等待者）
+type iiifHTTPError struct {
+    status int
+    code   string
+    err    error
+}
+
+func (e *iiifHTTPError) Error() string { return e.err.Error() }
+func (e *iiifHTTPError) Unwrap() error { return e.err }
+
+func newIIIFHTTPError(status int, code string, err error) error {
+    return &iiifHTTPError{status: status, code: code, err: err}
+}
+
+// 根据错误类型返回对应的IIIF错误响应
+func sendProcessingError(c *gin.Context, err error) {
+    var httpErr *iiifHTTPError
+    switch {
+    case errors.Is(err, errImageNotFound):
+        sendIIIFError(c, 404, "NotFound", err.Error())
+    case errors.Is(err, errPoolSaturated):
+        sendBusyError(c, err)
+    case errors.As(err, &httpErr):
+        sendIIIFError(c, httpErr.status, httpErr.code, err.Error())
+    default:
+        sendIIIFError(c, 500, "InternalServerError", err.Error())
+    }
+}
+
 
 func loadConfig() error {
     configFile := "config.yaml"
@@ -281,77 +340,25 @@ func initCacheManager() {
 //     if err := os.MkdirAll(cacheManager.cacheDir, 0755); err != nil {
 //         log.Fatalf("创建缓存目录失败: %v", err)
 //     }
+    cacheManager.removeLegacyKeyFiles()
 }
 
 
-// 获取缓存文件路径
-func (cm *CacheManager) getCachePath(identifier string) string {
-    // 使用identifier作为文件名，确保唯一性
-    cacheKey := generateCacheKey(identifier)
-    return filepath.Join(cm.cacheDir, cacheKey)
-}
-
-// 检查缓存是否存在
-func (cm *CacheManager) isCached(identifier string) (bool, string) {
-    ctx := context.Background()
-    cacheKey := generateCacheKey(identifier)
-    cachePath := cm.getCachePath(cacheKey)
-
-    // 检查本地是否有键文件
-    if _, err := os.Stat(cachePath); err != nil {
-        return false, ""
-    }
-
-    // 检查Redis是否有数据
-    exists, err := redisClient.Exists(ctx, cacheKey).Result()
+// 检查原图是否已缓存在Redis中（原图缓存只存Redis，由 redisTTL 控制过期）
+func (cm *CacheManager) isCached(identifier string) bool {
+    exists, err := redisClient.Exists(context.Background(), generateCacheKey(identifier)).Result()
     if err != nil {
         log.Printf("检查Redis缓存失败: %v", err)
-        return false, ""
+        return false
     }
-
     if exists == 1 {
-        log.Printf("✅ 缓存命中: %s", cachePath)
-        return true, cachePath
+        log.Printf("✅ 缓存命中: %s", identifier)
+        return true
     }
-
-    // 如果Redis没有数据，删除本地键文件（避免脏数据）
-    os.Remove(cachePath)
     log.Printf("❌ 缓存未命中: %s", identifier)
-    return false, ""
+    return false
 }
 
-// 添加文件到缓存
-func (cm *CacheManager) addToCache(identifier string, filePath string) (string, error) {
-    cm.mu.Lock()
-    defer cm.mu.Unlock()
-
-    ctx := context.Background()
-    cacheKey := generateCacheKey(identifier)
-    cachePath := cm.getCachePath(cacheKey)
-
-    // 读取文件内容
-    fileContent, err := os.ReadFile(filePath)
-    if err != nil {
-        return "", fmt.Errorf("读取文件内容失败: %v", err)
-    }
-
-    // 存入Redis（实际数据）
-    if err := redisClient.Set(ctx, cacheKey, fileContent, cm.redisTTL).Err(); err != nil {
-        return "", fmt.Errorf("Redis存储失败: %v", err)
-    }
-
-    // 在本地cache目录下创建一个空文件（仅作为键标记）
-    if err := os.WriteFile(cachePath, []byte(""), 0644); err != nil {
-        // 如果本地存储失败，回滚Redis操作
-        redisClient.Del(ctx, cacheKey)
-        return "", fmt.Errorf("创建缓存键文件失败: %v", err)
-    }
-
-    log.Printf("✅ 缓存成功: Key=%s, Size=%d bytes", cacheKey, len(fileContent))
-    return cachePath, nil
-}
-
-
 func (cm *CacheManager) getFromRedis(cacheKey string) ([]byte, error) {
     ctx := context.Background()
     data, err := redisClient.Get(ctx, cacheKey).Bytes()
@@ -361,185 +368,154 @@ func (cm *CacheManager) getFromRedis(cacheKey string) ([]byte, error) {
     return data, nil
 }
 
-// 清理缓存以释放指定大小的空间
-func (cm *CacheManager) cleanupCache() error {
-    cm.mu.Lock()
-    defer cm.mu.Unlock()
-
-    // 清理本地键文件
+// 删除旧版本留在 cacheDir 根目录下的空键文件，现在磁盘上的缓存都由 DiskCache 管理
+func (cm *CacheManager) removeLegacyKeyFiles() {
     entries, err := os.ReadDir(cm.cacheDir)
     if err != nil {
-        return fmt.Errorf("读取缓存目录失败: %v", err)
+        return
     }
-
-    // 按修改时间排序（旧文件优先删除）
-    sort.Slice(entries, func(i, j int) bool {
-        info1, _ := entries[i].Info()
-        info2, _ := entries[j].Info()
-        return info1.ModTime().Before(info2.ModTime())
-    })
-
-    // 删除前N个旧文件（最多清理100个）
-    maxCleanup := 100
-    deleted := 0
-
+    removed := 0
     for _, entry := range entries {
-        if deleted >= maxCleanup {
-            break
-        }
-
-        filePath := filepath.Join(cm.cacheDir, entry.Name())
-        if err := os.Remove(filePath); err != nil {
-            log.Printf("警告: 无法删除键文件 %s: %v", filePath, err)
+        if entry.IsDir() || !legacyKeyFileRegex.MatchString(entry.Name()) {
             continue
         }
-        deleted++
+        if err := os.Remove(filepath.Join(cm.cacheDir, entry.Name())); err == nil {
+            removed++
+        }
+    }
+    if removed > 0 {
+        log.Printf("已删除 %d 个旧版本地键文件", removed)
     }
-
-    log.Printf("清理完成: 删除 %d 个本地键文件", deleted)
-    return nil
 }
 
-func initMinIO() error {
-	var err error
-	minioClient, err = minio.New(config.MinIO.Endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(config.MinIO.AccessKey, config.MinIO.SecretKey, ""),
-		Secure: false,
-	})
-	if err != nil {
-		return fmt.Errorf("❌    初始化MinIO客户端失败: %v", err)
-	}
+var legacyKeyFileRegex = regexp.MustCompile(`^[0-9a-f]{64}$`)
 
-	// 测试连接
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+// 已获取的原图：本地文件只给出路径，其他来源给出内存中的数据
+type sourceImage struct {
+    Identifier string // 请求中的标识符
+    Path string     // 本地文件路径，由 libvips 按路径加载
+    Data []byte     // 图像数据（远程对象、Redis缓存，或无法按路径加载时读取的本地文件）
+    Info SourceInfo // 图片源元信息
+    Source ImageSource // 所在图片源
 
-	_, err = minioClient.ListBuckets(ctx)
-	if err != nil {
-		return fmt.Errorf("❌    无法连接到MinIO: %v", err)
-	}
+    readOnce sync.Once
+    readErr  error
 
-	log.Println("✅    MinIO连接成功")
-	return nil
+    dimsOnce sync.Once
+    dimsVal  imageDims
+    dimsErr  error
 }
 
-func getImageFromMinIO(identifier string) (string, error) {
-    // 先检查对象是否存在，避免无谓的临时文件创建
-    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-    defer cancel()
+// 图像数据：本地文件通常按路径加载（见 sourceImage.load），只有无法按路径加载的
+// （带方向标签、CMYK、文件头无法识别的格式）才读入内存，同一请求内只读取一次
+func (si *sourceImage) bytes() ([]byte, error) {
+    si.readOnce.Do(func() {
+        if si.Data == nil && si.Path != "" {
+            si.Data, si.readErr = os.ReadFile(si.Path)
+        }
+    })
+    return si.Data, si.readErr
+}
 
-    if _, err := minioClient.StatObject(ctx, config.MinIO.Bucket, identifier, minio.StatObjectOptions{}); err != nil {
-        return "", fmt.Errorf("图像不存在: %v", err) // 直接返回，不创建临时文件
-    }
-    // 创建临时文件（用于存储下载的图片）
-    tmpFile, err := os.CreateTemp(config.CacheDir, "minio-*.tmp")
+// 解码原图，不写临时文件
+func (si *sourceImage) decode(params *vips.ImportParams) (*vips.ImageRef, error) {
+    data, err := si.bytes()
     if err != nil {
-        return "", fmt.Errorf("创建临时文件失败: %v", err)
+        return nil, fmt.Errorf("读取本地图片失败: %v", err)
     }
-    tmpFilePath := tmpFile.Name()  // 保存临时文件路径
-    tmpFile.Close()  // 立即关闭文件，稍后通过路径写入
+    return vips.LoadImageFromBuffer(data, params)
+}
 
-    log.Printf("从MinIO下载: bucket=%s, key=%s, 临时文件=%s",
-        config.MinIO.Bucket, identifier, tmpFilePath)
+var sourceFlight flightGroup[*sourceImage] // 合并同一标识符的并发原图获取
 
-    // 从 MinIO 下载文件
-    ctx, cancel = context.WithTimeout(context.Background(), 30*time.Second)
-    defer cancel()
-
-    object, err := minioClient.GetObject(ctx, config.MinIO.Bucket, identifier, minio.GetObjectOptions{})
-    if err != nil {
-        return "", fmt.Errorf("从MinIO获取对象失败: %v", err)
-    }
-    defer object.Close()
-
-    // 检查对象是否存在
-    stat, err := object.Stat()
-    if err != nil {
-        return "", fmt.Errorf("获取MinIO对象状态失败: %v", err)
+func getImagePath(identifier string) (*sourceImage, error) {
+    src, err, shared := sourceFlight.Do(identifier, func() (*sourceImage, error) {
+        return fetchSourceImage(identifier)
+    })
+    if shared {
+        log.Printf("合并原图获取: %s", identifier)
     }
+    return src, err
+}
 
-    if stat.Size == 0 {
-        return "", errors.New("对象为空")
-    }
+func fetchSourceImage(identifier string) (*sourceImage, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+    defer cancel()
 
-    // 将 MinIO 文件写入临时文件
-    file, err := os.OpenFile(tmpFilePath, os.O_WRONLY, 0644)
+    resolved, err := resolveIdentifier(ctx, identifier)
     if err != nil {
-        return "", fmt.Errorf("打开临时文件进行写入失败: %v", err)
+        return nil, err
     }
-    defer file.Close()
-
-    if _, err := io.Copy(file, object); err != nil {
-        return "", fmt.Errorf("从MinIO下载对象失败: %v", err)
+    // 本地文件只记录路径，需要解码时才读取，不写入Redis缓存
+    if resolved.Info.Path != "" {
+        return &sourceImage{Identifier: identifier, Path: resolved.Info.Path, Info: resolved.Info, Source: resolved.Source}, nil
     }
 
-    log.Printf("成功从MinIO下载: %s -> %s", identifier, tmpFilePath)
-    return tmpFilePath, nil
-}
-
-var identifierLocks sync.Map // key: identifier, value: *sync.Mutex
-func getImagePath(identifier string) ([]byte, error) {
-    muInterface, _ := identifierLocks.LoadOrStore(identifier, &sync.Mutex{})
-    mu := muInterface.(*sync.Mutex)
-    mu.Lock()
-    defer mu.Unlock()
-
-    // 如果 readMinIO 为 false，直接从本地读取
-    if !config.ReadMinIO {
-        localPath := filepath.Join(config.ImageDir, identifier)
-        imgData, err := os.ReadFile(localPath)
-        if err != nil {
-            return nil, fmt.Errorf("本地图片不存在: %v", err)
+    // 检查缓存（缓存键包含原图版本，原图更新后不会读到旧数据）
+    versionedID := identifier + "@" + sourceVersion(resolved.Info)
+    if cacheManager != nil {
+        if cacheManager.isCached(versionedID) {
+            log.Printf("从缓存加载图像: %s", identifier)
+            imgData, err := cacheManager.getFromRedis(generateCacheKey(versionedID))
+            if err != nil {
+                return nil, err
+            }
+            return &sourceImage{Identifier: identifier, Data: imgData, Info: resolved.Info, Source: resolved.Source}, nil
         }
-        return imgData, nil
     }
 
-    // 检查缓存
-    if cached, _ := cacheManager.isCached(identifier); cached {
-        log.Printf("从缓存加载图像: %s", identifier)
-        return cacheManager.getFromRedis(generateCacheKey(identifier))
+    object, err := resolved.Source.Open(ctx, resolved.Info.Key)
+    if err != nil {
+        return nil, err
     }
+    defer object.Close()
 
-    // 从 MinIO 下载
-    tmpFilePath, err := getImageFromMinIO(identifier)
+    imgData, err := io.ReadAll(object)
     if err != nil {
-        // 明确检查是否为 "未找到" 错误
-        if strings.Contains(err.Error(), "The specified key does not exist") {
-            return nil, fmt.Errorf("图像不存在: %s", identifier)
-        }
-        return nil, fmt.Errorf("MinIO下载失败: %v", err)
+        return nil, fmt.Errorf("读取图像数据失败: %v", err)
+    }
+    if len(imgData) == 0 {
+        return nil, errors.New("对象为空")
     }
-    defer os.Remove(tmpFilePath) // 确保临时文件最终被删除
+    src := &sourceImage{Identifier: identifier, Data: imgData, Info: resolved.Info, Source: resolved.Source}
 
-    // 读取临时文件内容
-    imgData, err := os.ReadFile(tmpFilePath)
-    if err != nil {
-        return nil, fmt.Errorf("读取临时文件失败: %v", err)
+    if cacheManager == nil {
+        return src, nil
     }
 
     // 只有成功获取图像数据后，才写入缓存
-    cacheKey := generateCacheKey(identifier)
+    cacheKey := generateCacheKey(versionedID)
     if err := redisClient.Set(context.Background(), cacheKey, imgData, cacheManager.redisTTL).Err(); err != nil {
         log.Printf("警告: Redis缓存写入失败（但图像有效）: %v", err)
-    } else {
-        // 仅在 Redis 写入成功时创建本地键文件
-        cachePath := cacheManager.getCachePath(cacheKey)
-        if err := os.WriteFile(cachePath, []byte(""), 0644); err != nil {
-            log.Printf("警告: 本地键文件创建失败: %v", err)
-        }
     }
 
-    return imgData, nil
+    return src, nil
 }
 
 
 func main() {
+    setup()
+
     // 初始化libvips（线程安全）
     vipsInit.Do(func() {
-        vips.Startup(nil)
+        vips.Startup(vipsStartupConfig())
     })
     defer vips.Shutdown()
 
+    // 子命令
+    if len(os.Args) > 1 {
+        switch os.Args[1] {
+        case "convert":
+            if err := runConvert(os.Args[2:]); err != nil {
+                log.Fatalf("convert 执行失败: %v", err)
+            }
+            return
+        }
+    }
+
+    // 检测当前 libvips 支持的输出格式
+    detectOutputFormats()
+
     // 设置Gin模式
     gin.SetMode(gin.ReleaseMode)
     r := gin.Default()
@@ -582,6 +558,9 @@ func main() {
         }
         c.Header("Access-Control-Allow-Headers", headers)
 
+        // 允许浏览器脚本读取 Link 头（canonical / profile）
+        c.Header("Access-Control-Expose-Headers", "Link")
+
         // 处理OPTIONS请求
         if c.Request.Method == "OPTIONS" {
             c.AbortWithStatus(204)
@@ -590,23 +569,39 @@ func main() {
         c.Next()
     })
 
-    // 预编译IIIF 3.0标准正则
-    iiifRegex := regexp.MustCompile(
-        `^(.*?)/` + // identifier (group 1)
-        `(full|square|\d+,\d+,\d+,\d+|pct:\d+,\d+,\d+,\d+)/` + // region (group 2)
-        `(full|max|\d+,|,\d+|\d+,\d+|!?\d+,\d+|\^\d+,\d+|pct:\d+)/` + // size (group 3)
-        `(!?\d+)/` + // rotation (group 4)
-        `(default|color|gray|bitonal)\.` + // quality (group 5)
-        `(jpg|png|webp|gif|tif)$`, // format (group 6)
-    )
-
     // 基础路由
     r.GET("/", ginHomeHandler)
     r.GET("/health", ginHealthHandler)
     r.GET("/status", ginStatusHandler)
 
-    // IIIF路由处理
-    r.GET(fmt.Sprintf("/iiif/%s/*path", config.Version), func(c *gin.Context) {
+    // IIIF路由处理：每个路由前缀按配置的 Image API 版本解析请求
+    routes, err := configRoutes()
+    if err != nil {
+        log.Fatalf("路由配置无效: %v", err)
+    }
+    iiifRoutes = routes
+    for _, route := range routes {
+        r.GET(route.Path+"/*path", iiifHandler(route))
+        log.Printf("注册 IIIF Image API %d.x 路由: %s", route.API, route.Path)
+    }
+
+    // 启动服务器
+    addr := fmt.Sprintf("%s:%d", config.Host, config.Port)
+    log.Printf("Starting IIIF server at %s (IIIF version %s)", addr, config.Version)
+
+    if config.EnableHTTPS {
+        if config.CertFile == "" || config.KeyFile == "" {
+            log.Fatal("HTTPS enabled but missing cert/key files")
+        }
+        log.Fatal(r.RunTLS(addr, config.CertFile, config.KeyFile))
+    } else {
+        log.Fatal(r.Run(addr))
+    }
+}
+
+// IIIF 请求处理：info.json 或图像请求
+func iiifHandler(route iiifRoute) gin.HandlerFunc {
+    return func(c *gin.Context) {
         // 获取并清理路径
         rawPath := c.Param("path")
         cleanedPath := filepath.ToSlash(filepath.Clean(rawPath))
@@ -627,46 +622,34 @@ func main() {
         // 处理info.json请求
         if strings.HasSuffix(decodedPath, "info.json") {
             identifier := strings.TrimSuffix(decodedPath, "/info.json")
-            ginMinioInfoHandler(c, identifier)
+            ginMinioInfoHandler(c, route, identifier)
             return
         }
 
-        // 验证图像请求格式
-        if !iiifRegex.MatchString(decodedPath) {
-            sendIIIFError(c, 400, "InvalidRequest", "URL格式不符合IIIF规范")
+        // 验证并提取图像请求参数
+        req, ok := route.parseImageRequest(decodedPath)
+        if !ok && isBaseURIRequest(strings.TrimPrefix(decodedPath, "/")) {
+            // 基础 URI 重定向到 info.json
+            c.Redirect(303, route.serviceID(c.Request, decodedPath)+"/info.json")
             return
         }
-
-        // 提取参数
-        matches := iiifRegex.FindStringSubmatch(decodedPath)
-        req := IIIFRequest{
-            Identifier: matches[1],
-            Region:     matches[2],
-            Size:       matches[3],
-            Rotation:   matches[4],
-            Quality:    matches[5],
-            Format:     matches[6],
+        if !ok {
+            sendIIIFError(c, 400, "InvalidRequest", "URL格式不符合IIIF规范")
+            return
         }
 
         // 处理图像请求
-        ginImageHandler(c, req)
-    })
-
-    // 启动服务器
-    addr := fmt.Sprintf("%s:%d", config.Host, config.Port)
-    log.Printf("Starting IIIF server at %s (IIIF version %s)", addr, config.Version)
-
-    if config.EnableHTTPS {
-        if config.CertFile == "" || config.KeyFile == "" {
-            log.Fatal("HTTPS enabled but missing cert/key files")
-        }
-        log.Fatal(r.RunTLS(addr, config.CertFile, config.KeyFile))
-    } else {
-        log.Fatal(r.Run(addr))
+        ginImageHandler(c, route, req)
     }
 }
 
 func ginHomeHandler(c *gin.Context) {
+    // 示例地址使用客户端可访问的第一个 IIIF 路由
+    exampleBase := requestBaseURL(c.Request) + "/iiif/" + config.Version
+    if len(iiifRoutes) > 0 {
+        exampleBase = iiifRoutes[0].baseURL(c.Request)
+    }
+
     c.Header("Content-Type", "text/html")
     c.String(200, fmt.Sprintf(`
 <!DOCTYPE html>
@@ -791,10 +774,10 @@ func ginHomeHandler(c *gin.Context) {
             <p>动态处理并返回图像，支持多种处理参数：</p>
             <ul>
                 <li><strong>region</strong>: 图像区域 (full, square, x,y,w,h, pct:x,y,w,h)</li>
-                <li><strong>size</strong>: 尺寸调整 (full, max, w,h, pct:n, !w,h, ^w,h)</li>
-                <li><strong>rotation</strong>: 旋转角度 (0, 90, 180, 270)</li>
+                <li><strong>size</strong>: 尺寸调整 (max, w,, ,h, w,h, pct:n, !w,h，加 ^ 前缀允许放大)</li>
+                <li><strong>rotation</strong>: 旋转角度 (0-360 的任意角度，加 ! 前缀先水平镜像)</li>
                 <li><strong>quality</strong>: 质量 (default, color, gray, bitonal)</li>
-                <li><strong>format</strong>: 格式 (jpg, png, webp, gif)</li>
+                <li><strong>format</strong>: 格式 (%s)</li>
             </ul>
         </div>
 
@@ -830,11 +813,11 @@ func ginHomeHandler(c *gin.Context) {
         <h2>使用示例</h2>
         <div class="endpoint">
             <strong>获取图像信息</strong>
-            <p><code>%s/iiif/%s/sample-image/info.json</code></p>
+            <p><code>%s/sample-image/info.json</code></p>
         </div>
         <div class="endpoint">
             <strong>获取缩略图 (300x300)</strong>
-            <p><code>%s/iiif/%s/sample-image/full/^300,300/0/default.jpg</code></p>
+            <p><code>%s/sample-image/full/^300,300/0/default.jpg</code></p>
         </div>
 
         <div class="footer">
@@ -847,8 +830,9 @@ func ginHomeHandler(c *gin.Context) {
     `,
     config.Host,  // 标题
     config.Version,  // 版本号
-    config.Host, config.Version,  // 示例URL
-    config.Host, config.Version,  // 示例URL
+    strings.Join(supportedFormats(), ", "),  // 输出格式
+    exampleBase,  // 示例URL
+    exampleBase,  // 示例URL
     config.Version,  // 页脚信息
     startTime.Format("2006-01-02 15:04:05"),  // 启动时间
     time.Since(startTime).Round(time.Second).String(),  // 运行时间
@@ -897,118 +881,169 @@ func ginStatusHandler(c *gin.Context) {
 		MemoryStats:  memStats,
 		CacheSize:    cacheSize,
         ImageCount:   imageCount,
+		Processing:   processingPool.Stats(),
+	}
+	if sharedDiskCache != nil {
+		stats := sharedDiskCache.Stats()
+		status.DiskCache = &stats
 	}
 	c.JSON(200, status)
 }
 
-func ginMinioInfoHandler(c *gin.Context, identifier string) {
+func ginMinioInfoHandler(c *gin.Context, route iiifRoute, identifier string) {
     log.Printf("获取MinIO图像信息: %s", identifier)
 
-    // 获取图像数据
-    imgData, err := getImagePath(identifier)
+    // 根据原图版本处理条件请求
+    resolved, err := resolveIdentifier(c.Request.Context(), identifier)
     if err != nil {
-        log.Printf("获取图像失败: %v", err)
-        if strings.Contains(err.Error(), "未找到") {
-            sendIIIFError(c, 404, "NotFound", err.Error())
-        } else {
-            sendIIIFError(c, 500, "InternalServerError", err.Error())
-        }
+        log.Printf("获取图像信息失败: %v", err)
+        sendProcessingError(c, err)
+        return
+    }
+    id := route.serviceID(c.Request, identifier)
+    contentType := route.negotiateInfoContentType(c.Request)
+    c.Header("Vary", "Accept")
+    etag := makeETag(sourceVersion(resolved.Info), identifier, "info.json", id, strconv.Itoa(route.API), contentType)
+    if checkConditional(c, etag, resolved.Info.ModTime, config.HTTPCache.InfoCacheControl) {
         return
     }
 
-
-    // 创建临时文件处理图像
-    tmpFile, err := os.CreateTemp("", "iiif-info-tmp-*")
+    // 优先使用按原图版本缓存的尺寸，未命中时只读取一次图像
+    dims, err := imageDimsFor(identifier, resolved)
     if err != nil {
-        log.Printf("创建临时文件失败: %v", err)
-        sendIIIFError(c, 500, "InternalServerError", "创建临时文件失败")
+        log.Printf("获取图像信息失败: %v", err)
+        sendProcessingError(c, err)
         return
     }
-    defer func() {
-        tmpFile.Close()
-        if err := os.Remove(tmpFile.Name()); err != nil {
-            log.Printf("删除临时文件失败: %v", err)
-        }
-    }()
+    // 根据图像尺寸和服务器能力构建 info.json
+    info := buildInfo(id, dims.Width, dims.Height)
 
-    // 写入图像数据到临时文件
-    if _, err := tmpFile.Write(imgData); err != nil {
-        log.Printf("写入临时文件失败: %v", err)
-        sendIIIFError(c, 500, "InternalServerError", "写入临时文件失败")
-        return
+    // 返回JSON响应，2.1 路由转换为 2.1 格式
+    var body interface{} = info
+    if route.API == 2 {
+        body = convertInfoV2(info)
     }
-    if err := tmpFile.Sync(); err != nil {
-        log.Printf("同步临时文件失败: %v", err)
+    c.Header("Content-Type", contentType)
+    if err := json.NewEncoder(c.Writer).Encode(body); err != nil {
+        log.Printf("JSON编码失败: %v", err)
     }
+}
 
-    // 打开图片文件
-    img, err := vips.NewImageFromFile(tmpFile.Name())
+// 图像元数据（info.json 和处理计划所需），按原图版本缓存
+type imageDims struct {
+    Width  int    `json:"width"`
+    Height int    `json:"height"`
+    Bands  int    `json:"bands,omitempty"`
+    Format string `json:"format,omitempty"`
+    Pages  int    `json:"pages,omitempty"`
+    Levels []pyramidLevel `json:"levels,omitempty"` // 金字塔TIFF的各层尺寸
+    Orientation int `json:"orientation,omitempty"` // EXIF/TIFF 方向标签
+    CMYK bool `json:"cmyk,omitempty"` // CMYK 图像
+}
+
+var infoFlight flightGroup[imageDims] // 合并同一图像版本的并发 info.json 计算
+
+// 读取已解析原图的元数据
+func loadImageDims(identifier string, resolved resolvedImage) (imageDims, error) {
+    // 优先只读取文件头（本地文件 pread，MinIO 范围请求），无法识别时再完整读取
+    dims, err := probeSource(context.Background(), resolved)
+    if err == nil {
+        return dims, nil
+    }
+    if errors.Is(err, errImageNotFound) {
+        return imageDims{}, err
+    }
+    log.Printf("文件头探测失败，使用libvips读取: %v", err)
+
+    // 获取图像数据
+    src, err := getImagePath(identifier)
     if err != nil {
-        log.Printf("读取图像失败: %v", err)
-        sendIIIFError(c, 500, "InternalServerError", fmt.Sprintf("读取图像错误: %v", err))
-        return
+        return imageDims{}, err
     }
-    defer img.Close()
+    return src.decodeDims()
+}
 
-    // 获取图片尺寸信息
-    width := img.Width()
-    height := img.Height()
-
-    // 构建IIIF info.json响应
-    info := IIIFInfo{
-        Context:        "http://iiif.io/api/image/3/context.json",
-        ID:             fmt.Sprintf("http://%s:%d/iiif/%s/%s", config.Host, config.Port,config.Version , strings.Trim(identifier, "/")),
-//         ID:             fmt.Sprintf("http://t677cea3.natappfree.cc/iiif/V1/%s", strings.Trim(identifier, "/")),
-        Type:           "sc:Manifest",
-        Protocol:       "http://iiif.io/api/image",
-        Width:          width,
-        Height:         height,
-        Profile: []string{
-            "http://iiif.io/api/image/3/level2.json",  // 主合规级别
-            "http://iiif.io/api/image/3/profiles/level2.json", // 兼容性格式
-        },
-
-        Tiles: []Tile{
-            {
-                Width:        512,
-                ScaleFactors: []int{1, 2, 4, 8},
-            },
-        },
-        Sizes: []Size{
-            {Width: width, Height: height},
-            {Width: width / 2, Height: height / 2},
-            {Width: width / 4, Height: height / 4},
-        },
-
-        ExtraFormats:   []string{"jpg", "png", "webp", "gif"},
-        ExtraQualities: []string{"default", "color", "gray", "bitonal"},
-        ExtraFeatures:  []string{
-            "regionByPct",       // 百分比区域
-            "regionSquare",      // 方形区域
-            "sizeByWhListed",    // 明确尺寸
-            "sizeByPct",         // 百分比缩放
-            "sizeByW",           // 按宽度缩放
-            "sizeByH",           // 按高度缩放
-            "sizeByConfinedWh",  // 限制框缩放
-            "sizeByDistortedWh", // 非等比缩放 (^语法)
-            "rotationBy90s",  // 明确声明仅支持90度倍数旋转
-//             "mirroring",          // 支持!翻转
-            "regionSquare",
-        },
-    }
-
-    // 返回JSON响应
-    c.Header("Content-Type", "application/json")
-    if err := json.NewEncoder(c.Writer).Encode(info); err != nil {
-        log.Printf("JSON编码失败: %v", err)
+// 原图元数据，先查按版本缓存的元数据，未命中时读取文件头。结果保存在 sourceImage 中，
+// 请求在获取处理槽位前取得一次，之后（持有槽位时）不会再触发读取或解码
+func (si *sourceImage) dims() (imageDims, error) {
+    si.dimsOnce.Do(func() {
+        si.dimsVal, si.dimsErr = cachedImageDims(si.Identifier, sourceVersion(si.Info), si.loadDims)
+    })
+    return si.dimsVal, si.dimsErr
+}
+
+// 读取文件头获取元数据，无法识别的格式用libvips解码（decodeDims 自行获取处理槽位）
+func (si *sourceImage) loadDims() (imageDims, error) {
+    var res probeResult
+    var err error
+    if si.Path != "" {
+        var f *os.File
+        if f, err = os.Open(si.Path); err == nil {
+            res, err = probeImage(f)
+            f.Close()
+        }
+    } else {
+        res, err = probeImage(bytes.NewReader(si.Data))
+    }
+    if err == nil {
+        return dimsFromProbe(res), nil
+    }
+    return si.decodeDims()
+}
+
+// 用libvips解析文件头获取元数据，多页TIFF逐页读取尺寸。解码前获取处理槽位，调用方不能持有槽位
+func (si *sourceImage) decodeDims() (imageDims, error) {
+    release, err := processingPool.Acquire(context.Background())
+    if err != nil {
+        return imageDims{}, err
+    }
+    defer release()
+
+    img, err := si.decode(nil)
+    if err != nil {
+        return imageDims{}, fmt.Errorf("读取图像错误: %v", err)
+    }
+    dims := imageDims{
+        Width:  img.Width(),
+        Height: img.Height(),
+        Bands:  img.Bands(),
+        Format: vips.ImageTypes[img.Format()],
+        Pages:  img.Pages(),
+        Orientation: img.Orientation(),
+        CMYK: img.Interpretation() == vips.InterpretationCMYK,
     }
+    img.Close()
+
+    if img.Format() == vips.ImageTypeTIFF && dims.Pages > 1 {
+        sizes := []pageSize{{Width: dims.Width, Height: dims.Height}}
+        for page := 1; page < dims.Pages; page++ {
+            params := vips.NewImportParams()
+            params.Page.Set(page)
+            pageImg, err := si.decode(params)
+            if err != nil {
+                break
+            }
+            sizes = append(sizes, pageSize{Width: pageImg.Width(), Height: pageImg.Height()})
+            pageImg.Close()
+        }
+        if levels := pyramidLevelsFromPages(sizes); len(levels) > 1 {
+            dims.Levels = levels
+        }
+    }
+    return dims, nil
 }
 
-func ginImageHandler(c *gin.Context, req IIIFRequest) {
+func ginImageHandler(c *gin.Context, route iiifRoute, req IIIFRequest) {
+    // default 格式按 Accept 头选择实际格式，之后的缓存键、ETag 和 Link 头都使用实际格式
+    if req.Format == negotiatedFormatName && config.FormatNegotiation.Enabled {
+        req.Format = negotiateImageFormat(c.Request)
+        c.Header("Vary", "Accept")
+    }
+
     // 验证参数有效性
     if !isValidFormat(req.Format) {
         sendIIIFError(c, 400, "InvalidRequest",
-            fmt.Sprintf("Unsupported format: %s. Supported: jpg, png, webp, gif", req.Format))
+            fmt.Sprintf("Unsupported format: %s. Supported: %s", req.Format, strings.Join(supportedFormats(), ", ")))
         return
     }
 
@@ -1018,391 +1053,216 @@ func ginImageHandler(c *gin.Context, req IIIFRequest) {
         return
     }
 
-    // 获取图像数据
-    imgData, err := getImagePath(req.Identifier)
-    if err != nil {
-        log.Printf("获取图像失败: %v", err)
-        if strings.Contains(err.Error(), "未找到") {
-            sendIIIFError(c, 404, "NotFound", err.Error())
-        } else {
-            sendIIIFError(c, 500, "InternalServerError", err.Error())
-        }
+    // 条件请求之前先校验 region、size、rotation 语法，无效请求始终返回 400 而不是 304
+    if err := validateIIIFSyntax(req); err != nil {
+        sendIIIFError(c, 400, "InvalidRequest", err.Error())
         return
     }
 
-    // 创建临时文件处理图像
-    tmpFile, err := os.CreateTemp("", "iiif-tmp-*")
+    // 根据原图版本生成 ETag，处理条件请求
+    resolved, err := resolveIdentifier(c.Request.Context(), req.Identifier)
     if err != nil {
-        sendIIIFError(c, 500, "InternalServerError", "创建临时文件失败")
+        log.Printf("获取图像信息失败: %v", err)
+        sendProcessingError(c, err)
         return
     }
-    defer os.Remove(tmpFile.Name())
-    defer tmpFile.Close()
+    version := sourceVersion(resolved.Info)
+    etag := makeETag(version, canonicalRequestTuple(req)...)
+    if checkConditional(c, etag, resolved.Info.ModTime, config.HTTPCache.CacheControl) {
+        return
+    }
+
+    // 检查派生图缓存
+    cacheKey := derivativeCacheKey(req, version)
+    if derivCache != nil {
+        if data, ok := derivCache.Get(cacheKey); ok {
+            writeLinkHeaders(c, route, req, version)
+            c.Data(200, formatMIME(req.Format), data)
+            return
+        }
+    }
 
-    if _, err := tmpFile.Write(imgData); err != nil {
-        sendIIIFError(c, 500, "InternalServerError", "写入临时文件失败")
+    // 相同请求并发到达时只渲染一次，其余请求共享结果
+    imageBytes, err, shared := renderFlight.Do(cacheKey, func() ([]byte, error) {
+        return renderImage(req, cacheKey)
+    })
+    if err != nil {
+        log.Printf("图像请求失败: %v", err)
+        sendProcessingError(c, err)
         return
     }
+    if shared {
+        log.Printf("合并图像渲染: %s", req.Identifier)
+    }
+
+    // 返回处理后的图片
+    writeLinkHeaders(c, route, req, version)
+    c.Data(200, formatMIME(req.Format), imageBytes)
+}
+
+var renderFlight flightGroup[[]byte] // 合并相同派生图的并发渲染
+
+// 获取原图、处理并导出，成功后写入派生图缓存
+func renderImage(req IIIFRequest, cacheKey string) ([]byte, error) {
+    // 获取图像数据
+    src, err := getImagePath(req.Identifier)
+    if err != nil {
+        return nil, err
+    }
+
+    // 先取得原图元数据（通常命中缓存），避免持有处理槽位时等待 info.json 的计算；
+    // 文件头无法识别时 decodeDims 会自行获取槽位后解码
+    if _, err := src.dims(); err != nil {
+        return nil, err
+    }
+
+    // 获取处理槽位，限制同时运行的libvips处理数量
+    release, err := processingPool.Acquire(context.Background())
+    if err != nil {
+        return nil, err
+    }
+    defer release()
 
     // 处理图像
-    img, err := processImage(tmpFile.Name(), req)
+    img, err := processImage(src, req)
     if err != nil {
-        log.Printf("图像处理失败: %v", err)
-        sendIIIFError(c, 400, "InvalidRequest", fmt.Sprintf("图像处理失败: %v", err))
-        return
+        return nil, newIIIFHTTPError(400, "InvalidRequest", fmt.Errorf("图像处理失败: %v", err))
     }
     defer img.Close()
 
-    // 导出处理后的图片
-    var imageBytes []byte
-    var exportErr error
-
-    switch req.Format {
-    case "jpg", "jpeg":
-        params := vips.NewJpegExportParams()
-        params.Quality = 85
-        imageBytes, _, exportErr = img.ExportJpeg(params)
-    case "png":
-        params := vips.NewPngExportParams()
-        imageBytes, _, exportErr = img.ExportPng(params)
-    case "webp":
-        params := vips.NewWebpExportParams()
-        imageBytes, _, exportErr = img.ExportWebp(params)
-    case "gif":
-        params := vips.NewGifExportParams()
-        imageBytes, _, exportErr = img.ExportGIF(params)
-    default:
-        exportErr = fmt.Errorf("unsupported format: %s", req.Format)
-    }
+    // 按请求格式和编码参数导出处理后的图片
+    imageBytes, exportErr := exportImage(img, req)
 
     if exportErr != nil {
-        sendIIIFError(c, 500, "InternalError", fmt.Sprintf("导出失败: %v", exportErr))
-        return
+        return nil, newIIIFHTTPError(500, "InternalError", fmt.Errorf("导出失败: %v", exportErr))
     }
 
-    // 返回处理后的图片
-    c.Data(200, "image/"+req.Format, imageBytes)
+    if derivCache != nil {
+        derivCache.Put(cacheKey, imageBytes)
+    }
+    return imageBytes, nil
 }
 
 // 辅助函数 - 验证格式是否支持
 func isValidFormat(format string) bool {
-    switch format {
-    case "jpg", "jpeg", "png", "webp", "gif":
-        return true
-    default:
-        return false
-    }
+    _, ok := lookupFormat(format)
+    return ok
 }
 
 // 辅助函数 - 验证质量参数是否支持
 func isValidQuality(quality string) bool {
-    switch quality {
-    case "default", "color", "gray", "bitonal":
-        return true
-    default:
-        return false
+    for _, q := range supportedQualities() {
+        if q == quality {
+            return true
+        }
+    }
+    return false
+}
+
+// 辅助函数 - 校验 region、size、rotation 的语法（与原图尺寸相关的检查在处理时进行）
+func validateIIIFSyntax(req IIIFRequest) error {
+    if _, err := parseRegion(req.Region); err != nil {
+        return err
+    }
+    if _, err := parseSize(req.Size); err != nil {
+        return err
     }
+    if _, _, err := parseRotation(req.Rotation); err != nil {
+        return err
+    }
+    return nil
 }
 
 
-func processImage(path string, req IIIFRequest) (*vips.ImageRef, error) {
-    img, err := vips.NewImageFromFile(path)
+func processImage(src *sourceImage, req IIIFRequest) (*vips.ImageRef, error) {
+    // 先根据文件头计算处理计划，再按需解码
+    plan, err := planImage(src, req)
     if err != nil {
-        return nil, fmt.Errorf("读取图像错误: %v", err)
+        return nil, err
     }
 
-    if err := applyRegion(img, req.Region); err != nil {
-        return nil, fmt.Errorf("区域处理失败: %v", err)
+    img, err := decodeForPlan(src, plan)
+    if err != nil {
+        return nil, fmt.Errorf("读取图像错误: %v", err)
     }
+    maybeSchedulePyramid(src, plan)
 
-    if err := applySize(img, req.Size); err != nil {
-        return nil, fmt.Errorf("尺寸处理失败: %v", err)
+    if err := applyColorManagement(img, req); err != nil {
+        img.Close()
+        return nil, fmt.Errorf("色彩管理失败: %v", err)
     }
 
-    if err := applyRotation(img, req.Rotation); err != nil {
+    if err := applyRotation(img, req.Rotation, req.Format); err != nil {
+        img.Close()
         return nil, fmt.Errorf("旋转处理失败: %v", err)
     }
 
-    if err := applyQuality(img, req.Quality); err != nil {
+    img, err = applyQuality(img, req.Quality)
+    if err != nil {
+        img.Close()
         return nil, fmt.Errorf("质量处理失败: %v", err)
     }
 
     return img, nil
 }
 
-func applyRegion(img *vips.ImageRef, region string) error {
-	if region == "full" {
-		return nil
-	}
-
-	width := img.Width()
-	height := img.Height()
-
-	var x, y, w, h int
-
-	if strings.HasPrefix(region, "pct:") {
-		parts := strings.Split(region[4:], ",")
-		if len(parts) != 4 {
-			return errors.New("区域格式无效")
-		}
-
-		xPct, err1 := strconv.ParseFloat(parts[0], 64)
-		yPct, err2 := strconv.ParseFloat(parts[1], 64)
-		wPct, err3 := strconv.ParseFloat(parts[2], 64)
-		hPct, err4 := strconv.ParseFloat(parts[3], 64)
-
-		if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
-			return errors.New("区域值无效")
-		}
-
-		x = int(float64(width) * xPct / 100)
-		y = int(float64(height) * yPct / 100)
-		w = int(float64(width) * wPct / 100)
-		h = int(float64(height) * hPct / 100)
-	} else if region == "square" {
-		if width > height {
-			x = (width - height) / 2
-			w = height
-			h = height
-		} else {
-			y = (height - width) / 2
-			w = width
-			h = width
-		}
-	} else {
-		parts := strings.Split(region, ",")
-		if len(parts) != 4 {
-			return errors.New("区域格式无效")
-		}
-
-		var err error
-		x, err = strconv.Atoi(parts[0])
-		if err != nil {
-			return errors.New("区域值无效")
-		}
-		y, err = strconv.Atoi(parts[1])
-		if err != nil {
-			return errors.New("区域值无效")
-		}
-		w, err = strconv.Atoi(parts[2])
-		if err != nil {
-			return errors.New("区域值无效")
-		}
-		h, err = strconv.Atoi(parts[3])
-		if err != nil {
-			return errors.New("区域值无效")
-		}
+// 根据原图尺寸计算请求区域（原图坐标）
+func computeRegion(region string, width, height int) (x, y, w, h int, err error) {
+	spec, err := parseRegion(region)
+	if err != nil {
+		return 0, 0, 0, 0, err
 	}
-
-	if x < 0 || y < 0 || w <= 0 || h <= 0 || x+w > width || y+h > height {
-        return fmt.Errorf("区域超出边界: x=%d, y=%d, w=%d, h=%d (图像尺寸: %dx%d)",
-            x, y, w, h, width, height)	}
-
-	return img.ExtractArea(x, y, w, h)
+	return spec.resolve(width, height)
 }
 
-func applySize(img *vips.ImageRef, size string) error {
+// 根据区域尺寸计算输出尺寸
+func computeSize(size string, width, height int) (int, int, error) {
     log.Printf("应用尺寸: %s", size)
 
-    width := img.Width()
-    height := img.Height()
-    if size == "full" {
-        // full 直接返回原始尺寸（不检查 maxPixels）
-        if width*height > config.MaxPixels {
-            return fmt.Errorf("请求完整尺寸 (%dx%d) 超过服务器限制 (%d 像素)",
-                width, height, config.MaxPixels)
-        }
-        return nil
-    }
-
-    if size == "max" {
-        // max 需要检查是否超过 maxPixels
-        if width*height <= config.MaxPixels {
-            return nil // 原始尺寸在限制内，等同于 full
-        }
-        // 超过限制时，计算缩小比例
-        scale := math.Sqrt(float64(config.MaxPixels) / float64(width*height))
-        newWidth := int(float64(width) * scale)
-        newHeight := int(float64(height) * scale)
-        log.Printf("自动缩放到最大允许尺寸: %dx%d -> %dx%d",
-            width, height, newWidth, newHeight)
-        return img.Resize(float64(newWidth)/float64(width), vips.KernelLanczos3)
-    }
-    if width <= 0 || height <= 0 {
-        return errors.New("图像尺寸无效")
-    }
-
-    var newWidth, newHeight int
-    var err error
-
-    // 处理百分比缩放 (sizeByPct)
-    if strings.HasPrefix(size, "pct:") {
-        scale, err := strconv.ParseFloat(size[4:], 64)
-        if err != nil {
-            return errors.New("尺寸百分比值无效")
-        }
-        newWidth = int(float64(width) * scale / 100)
-        newHeight = int(float64(height) * scale / 100)
-
-    // 处理按宽度缩放 (sizeByW)
-    } else if strings.HasSuffix(size, ",") {
-        widthStr := strings.TrimSuffix(size, ",")
-        newWidth, err = strconv.Atoi(widthStr)
-        if err != nil {
-            return errors.New("宽度值无效")
-        }
-        newHeight = int(float64(height) * (float64(newWidth) / float64(width)))
-
-    // 处理按高度缩放 (sizeByH)
-    } else if strings.HasPrefix(size, ",") {
-        heightStr := strings.TrimPrefix(size, ",")
-        newHeight, err = strconv.Atoi(heightStr)
-        if err != nil {
-            return errors.New("高度值无效")
-        }
-        newWidth = int(float64(width) * (float64(newHeight) / float64(height)))
-
-    // 处理限定框缩放 (sizeByConfinedWh)
-    } else if strings.HasPrefix(size, "!") {
-        parts := strings.Split(size[1:], ",")
-        if len(parts) != 2 {
-            return errors.New("尺寸格式无效")
-        }
-
-        maxWidth, err := strconv.Atoi(parts[0])
-        if err != nil {
-            return errors.New("最大宽度值无效")
-        }
-        maxHeight, err := strconv.Atoi(parts[1])
-        if err != nil {
-            return errors.New("最大高度值无效")
-        }
-
-        ratio := min(float64(maxWidth)/float64(width), float64(maxHeight)/float64(height))
-        newWidth = int(float64(width) * ratio)
-        newHeight = int(float64(height) * ratio)
-
-    // 处理最佳匹配缩放 (sizeByWhListed)
-    } else if strings.HasPrefix(size, "^") {
-        parts := strings.Split(size[1:], ",")
-        if len(parts) != 2 {
-            return errors.New("尺寸格式无效")
-        }
-
-        targetWidth, err := strconv.Atoi(parts[0])
-        if err != nil {
-            return errors.New("目标宽度值无效")
-        }
-        targetHeight, err := strconv.Atoi(parts[1])
-        if err != nil {
-            return errors.New("目标高度值无效")
-        }
-
-        ratio := max(float64(targetWidth)/float64(width), float64(targetHeight)/float64(height))
-        newWidth = int(float64(width) * ratio)
-        newHeight = int(float64(height) * ratio)
-
-    // 处理标准 w,h 格式
-    } else {
-        parts := strings.Split(size, ",")
-        switch len(parts) {
-        case 1: // 单个数字 (隐式 sizeByW)
-            newWidth, err = strconv.Atoi(parts[0])
-            if err != nil {
-                return errors.New("宽度值无效")
-            }
-            newHeight = int(float64(height) * (float64(newWidth) / float64(width)))
-        case 2: // 明确指定 w,h
-            newWidth, err = strconv.Atoi(parts[0])
-            if err != nil {
-                return errors.New("宽度值无效")
-            }
-            newHeight, err = strconv.Atoi(parts[1])
-            if err != nil {
-                return errors.New("高度值无效")
-            }
-        default:
-            return errors.New("尺寸格式无效")
-        }
-    }
-
-    // 验证计算后的尺寸
-    if newWidth <= 0 || newHeight <= 0 {
-        return errors.New("计算得到的尺寸无效")
+    spec, err := parseSize(size)
+    if err != nil {
+        return 0, 0, err
     }
-
-    // 检查最大像素限制
-    if newWidth*newHeight > config.MaxPixels {
-        return fmt.Errorf("请求的尺寸 %dx%d 超过最大允许值 (%d 像素)",
-            newWidth, newHeight, config.MaxPixels)
+    newWidth, newHeight, err := spec.resolve(width, height, configSizeLimits())
+    if err != nil {
+        return 0, 0, err
     }
 
     log.Printf("将图像从 %dx%d 缩放为 %dx%d", width, height, newWidth, newHeight)
-
-    // 计算缩放比例并应用
-    scale := float64(newWidth) / float64(width)
-    return img.Resize(scale, vips.KernelLanczos3)
+    return newWidth, newHeight, nil
 }
 
 
-func applyRotation(img *vips.ImageRef, rotation string) error {
-	if rotation == "0" {
-		return nil
-	}
-
-	angle, err := strconv.ParseFloat(rotation, 64)
-	if err != nil {
-		return errors.New("旋转值无效")
-	}
-
-	var flip bool
-	if strings.HasPrefix(rotation, "!") {
-		flip = true
-		angle, err = strconv.ParseFloat(rotation[1:], 64)
-		if err != nil {
-			return errors.New("旋转值无效")
-		}
-	}
-
-	if flip {
-		if err := img.Flip(vips.DirectionHorizontal); err != nil {
-			return err
-		}
-	}
-	// 注意：govips 可能不支持任意角度旋转，这里我们只支持90度的倍数
-	var vipsAngle vips.Angle
-	switch {
-	case angle == 90:
-		vipsAngle = vips.Angle90
-	case angle == 180:
-		vipsAngle = vips.Angle180
-	case angle == 270:
-		vipsAngle = vips.Angle270
-	default:
-        return fmt.Errorf("仅支持0度(不旋转)、90、180和270度旋转，请求角度: %v", angle)
-	}
-
-	return img.Rotate(vipsAngle)
-}
-
-func applyQuality(img *vips.ImageRef, quality string) error {
+// 应用质量参数，bitonal 抖动时会返回新的图像；出错时返回的图像仍需由调用方关闭
+func applyQuality(img *vips.ImageRef, quality string) (*vips.ImageRef, error) {
 	switch quality {
 	case "default", "color":
-		return nil
+		return img, nil
 	case "gray":
-		return img.ToColorSpace(vips.InterpretationBW)
-	case "bitonal":
-		// 转换为灰度
 		if err := img.ToColorSpace(vips.InterpretationBW); err != nil {
-			return err
+			return img, err
+		}
+		return img, removeColorProfile(img)
+	case "bitonal":
+		// 按阈值（固定值或 Otsu）二值化，可选抖动
+		img, err := applyBitonal(img)
+		if err != nil {
+			return img, err
 		}
-		// 简单阈值处理
-		return img.Linear([]float64{1.0}, []float64{-128.0}) // 将128以下的像素设为0，以上的设为255
+		return img, removeColorProfile(img)
 	default:
-		return nil
+		return img, nil
 	}
 }
 
+// 灰度化后原有的彩色 profile 不再适用，输出按无 profile 的灰度图处理
+func removeColorProfile(img *vips.ImageRef) error {
+	if img.HasICCProfile() {
+		return img.RemoveICCProfile()
+	}
+	return nil
+}
+
 func min(a, b float64) float64 {
 	if a < b {
 		return a
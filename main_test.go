@@ -0,0 +1,16 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+func TestMain(m *testing.M) {
+	vips.LoggingSettings(nil, vips.LogLevelError)
+	vips.Startup(nil)
+	code := m.Run()
+	vips.Shutdown()
+	os.Exit(code)
+}
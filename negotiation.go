@@ -0,0 +1,68 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// 图像格式协商配置
+type FormatNegotiationConfig struct {
+	Enabled    bool     `yaml:"enabled"`    // 是否允许使用 default 格式，根据 Accept 头选择实际输出格式
+	Preference []string `yaml:"preference"` // 客户端同等接受时的优先顺序，默认 avif、webp、jpg
+}
+
+// 协商模式下 URL 中使用的格式名
+const negotiatedFormatName = "default"
+
+func negotiationPreference() []string {
+	if len(config.FormatNegotiation.Preference) > 0 {
+		return config.FormatNegotiation.Preference
+	}
+	return []string{"avif", "webp", "jpg"}
+}
+
+// 根据 Accept 头选择输出格式：取 q 值最高的可用格式，q 值相同时按配置的优先顺序，都不接受时使用 jpg
+func negotiateImageFormat(r *http.Request) string {
+	accepted := map[string]float64{}
+	wildcard := -1.0
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		switch mediaType {
+		case "*/*", "image/*":
+			wildcard = max(wildcard, q)
+		default:
+			accepted[mediaType] = max(accepted[mediaType], q)
+		}
+	}
+
+	best, bestQ := "jpg", 0.0
+	for _, name := range negotiationPreference() {
+		f, ok := lookupFormat(name)
+		if !ok {
+			continue
+		}
+		q, ok := accepted[f.MIME]
+		if !ok {
+			// 通配符只用于兜底的 jpg，避免向声明 image/* 的旧浏览器发送其无法解码的新格式
+			if f.Name != "jpg" {
+				continue
+			}
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = f.Name, q
+		}
+	}
+	return best
+}
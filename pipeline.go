@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// 图像处理计划：解码像素之前根据文件头计算出的区域和输出尺寸
+type imagePlan struct {
+	Width, Height int            // 原图尺寸
+	Format        vips.ImageType // 原图格式
+	Pages         int            // 页数（金字塔TIFF的每一层是一页）
+	Levels        []pyramidLevel // 金字塔层级，非金字塔图像为空
+	Orientation   int            // EXIF/TIFF 方向标签
+	CMYK          bool           // CMYK 图像
+
+	X, Y, W, H       int // 请求区域（原图坐标）
+	TargetW, TargetH int // 输出尺寸
+}
+
+// 区域是否为整幅图像
+func (p *imagePlan) isFullRegion() bool {
+	return p.X == 0 && p.Y == 0 && p.W == p.Width && p.H == p.Height
+}
+
+// 本地文件能否按路径加载：libvips thumbnail 会按方向标签自动旋转、把 CMYK 转为 sRGB，
+// 这类图像仍读入内存后按原样解码，与其他来源的处理结果保持一致
+func (p *imagePlan) loadByPath() bool {
+	return p.Orientation <= 1 && !p.CMYK
+}
+
+// 输出相对区域的缩小倍数（>=1 表示缩小）
+func (p *imagePlan) shrink() float64 {
+	return min(float64(p.W)/float64(p.TargetW), float64(p.H)/float64(p.TargetH))
+}
+
+// 金字塔中的一层
+type pyramidLevel struct {
+	Page   int `json:"page"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// 根据原图元数据（文件头探测结果，按原图版本缓存）计算区域和输出尺寸，不解码像素
+func planImage(src *sourceImage, req IIIFRequest) (*imagePlan, error) {
+	dims, err := src.dims()
+	if err != nil {
+		return nil, fmt.Errorf("读取图像错误: %v", err)
+	}
+	plan := &imagePlan{
+		Width:  dims.Width,
+		Height: dims.Height,
+		Format: imageTypeByName(dims.Format),
+		Pages:  dims.Pages,
+		Levels: dims.Levels,
+
+		Orientation: dims.Orientation,
+		CMYK:        dims.CMYK,
+	}
+
+	plan.X, plan.Y, plan.W, plan.H, err = computeRegion(req.Region, plan.Width, plan.Height)
+	if err != nil {
+		return nil, fmt.Errorf("区域处理失败: %v", err)
+	}
+	plan.TargetW, plan.TargetH, err = computeSize(req.Size, plan.W, plan.H)
+	if err != nil {
+		return nil, fmt.Errorf("尺寸处理失败: %v", err)
+	}
+	return plan, nil
+}
+
+// 按计划解码，尽量只解码需要的分辨率和区域：
+//   - JPEG 使用 libjpeg 的 shrink-on-load（1/2、1/4、1/8）
+//   - 金字塔 TIFF 选择不小于目标分辨率的最小一层
+//   - WebP/HEIF/AVIF 整图缩小时走 libvips thumbnail（WebP scale-on-load）
+//
+// 之后在解码结果上裁剪区域并缩放到输出尺寸。libvips 按需计算，本地分块 TIFF 按路径加载，
+// 裁剪只会读取区域覆盖到的分块。
+func decodeForPlan(src *sourceImage, plan *imagePlan) (*vips.ImageRef, error) {
+	shrink := plan.shrink()
+
+	var img *vips.ImageRef
+	var err error
+	switch {
+	case shrink >= 2 && plan.Format == vips.ImageTypeJPEG:
+		params := vips.NewImportParams()
+		factor := jpegShrinkFactor(shrink)
+		params.JpegShrinkFactor.Set(factor)
+		img, err = src.load(plan, params, (plan.Width+factor-1)/factor, (plan.Height+factor-1)/factor)
+	case shrink >= 2 && len(plan.Levels) > 1:
+		level := pickPyramidLevel(plan.Levels, plan, shrink)
+		params := vips.NewImportParams()
+		params.Page.Set(level.Page)
+		img, err = src.load(plan, params, level.Width, level.Height)
+	case shrink >= 2 && plan.isFullRegion() &&
+		(plan.Format == vips.ImageTypeWEBP || plan.Format == vips.ImageTypeHEIF || plan.Format == vips.ImageTypeAVIF):
+		return src.thumbnail(plan.TargetW, plan.TargetH)
+	default:
+		img, err = src.load(plan, nil, plan.Width, plan.Height)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cropAndResize(img, plan); err != nil {
+		img.Close()
+		return nil, err
+	}
+	return img, nil
+}
+
+// 在已解码（可能已缩小）的图像上裁剪区域并缩放到输出尺寸
+func cropAndResize(img *vips.ImageRef, plan *imagePlan) error {
+	if !plan.isFullRegion() {
+		sx := float64(img.Width()) / float64(plan.Width)
+		sy := float64(img.Height()) / float64(plan.Height)
+		x := int(math.Floor(float64(plan.X) * sx))
+		y := int(math.Floor(float64(plan.Y) * sy))
+		w := int(math.Max(1, math.Round(float64(plan.W)*sx)))
+		h := int(math.Max(1, math.Round(float64(plan.H)*sy)))
+		if x+w > img.Width() {
+			w = img.Width() - x
+		}
+		if y+h > img.Height() {
+			h = img.Height() - y
+		}
+		if err := img.ExtractArea(x, y, w, h); err != nil {
+			return fmt.Errorf("区域处理失败: %v", err)
+		}
+	}
+
+	if img.Width() != plan.TargetW || img.Height() != plan.TargetH {
+		hScale := float64(plan.TargetW) / float64(img.Width())
+		vScale := float64(plan.TargetH) / float64(img.Height())
+		if err := img.ResizeWithVScale(hScale, vScale, vips.KernelLanczos3); err != nil {
+			return fmt.Errorf("尺寸处理失败: %v", err)
+		}
+	}
+	return nil
+}
+
+// JPEG 解码时允许的最大缩小倍数（1、2、4、8）
+func jpegShrinkFactor(shrink float64) int {
+	factor := 1
+	for factor < 8 && float64(factor*2) <= shrink {
+		factor *= 2
+	}
+	return factor
+}
+
+// 由多页 TIFF 各页尺寸得到逐层缩小的金字塔层级（第0页为原图）
+func pyramidLevelsFromPages(pages []pageSize) []pyramidLevel {
+	if len(pages) == 0 {
+		return nil
+	}
+	first := pages[0]
+	if first.Width <= 0 || first.Height <= 0 {
+		return nil
+	}
+	aspect := float64(first.Width) / float64(first.Height)
+	levels := []pyramidLevel{{Page: 0, Width: first.Width, Height: first.Height}}
+	for page, size := range pages[1:] {
+		// 只接受宽高比一致且比上一层小的页，其余页（缩略图、附图等）结束金字塔
+		last := levels[len(levels)-1]
+		if size.Width <= 0 || size.Height <= 0 || size.Width >= last.Width || size.Height >= last.Height ||
+			math.Abs(float64(size.Width)/float64(size.Height)-aspect) > 0.01*aspect {
+			break
+		}
+		levels = append(levels, pyramidLevel{Page: page + 1, Width: size.Width, Height: size.Height})
+	}
+	return levels
+}
+
+// libvips 格式名对应的图像类型
+func imageTypeByName(name string) vips.ImageType {
+	for typ, n := range vips.ImageTypes {
+		if n == name {
+			return typ
+		}
+	}
+	return vips.ImageTypeUnknown
+}
+
+// 选择缩小倍数不超过 shrink 的最小层级，保证从该层缩放到目标尺寸时不需要放大
+func pickPyramidLevel(levels []pyramidLevel, plan *imagePlan, shrink float64) pyramidLevel {
+	best := levels[0]
+	for _, level := range levels[1:] {
+		if float64(plan.Width)/float64(level.Width) > shrink {
+			break
+		}
+		best = level
+	}
+	return best
+}
+
+// 按计划的解码尺寸加载原图。本地文件按路径交给 libvips thumbnail 并指定该尺寸，由 libvips 自己
+// 选择金字塔的页或 JPEG shrink-on-load，分块 TIFF 只读取用到的分块，不把整个文件读入内存；
+// 远程对象和 Redis 缓存的数据已在内存中，按 params 指定的页或缩小倍数解码
+func (si *sourceImage) load(plan *imagePlan, params *vips.ImportParams, width, height int) (*vips.ImageRef, error) {
+	if si.Path != "" && plan.loadByPath() {
+		return vips.LoadThumbnailFromFile(si.Path, width, height, vips.InterestingNone, vips.SizeForce, nil)
+	}
+	return si.decode(params)
+}
+
+// 使用 libvips thumbnail 直接生成目标尺寸，加载时即缩小
+func (si *sourceImage) thumbnail(width, height int) (*vips.ImageRef, error) {
+	if si.Path != "" {
+		return vips.LoadThumbnailFromFile(si.Path, width, height, vips.InterestingNone, vips.SizeForce, nil)
+	}
+	return vips.LoadThumbnailFromBuffer(si.Data, width, height, vips.InterestingNone, vips.SizeForce, nil)
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+func TestJpegShrinkFactor(t *testing.T) {
+	tests := []struct {
+		shrink float64
+		want   int
+	}{
+		{0.5, 1}, {1, 1}, {1.9, 1}, {2, 2}, {3.9, 2}, {4, 4}, {7.99, 4}, {8, 8}, {100, 8},
+	}
+	for _, tt := range tests {
+		if got := jpegShrinkFactor(tt.shrink); got != tt.want {
+			t.Errorf("jpegShrinkFactor(%v) = %d，期望 %d", tt.shrink, got, tt.want)
+		}
+	}
+}
+
+func TestPyramidLevelsFromPages(t *testing.T) {
+	tests := []struct {
+		name  string
+		pages []pageSize
+		want  []pyramidLevel
+	}{
+		{"无页", nil, nil},
+		{"首页尺寸无效", []pageSize{{0, 800}, {500, 400}}, nil},
+		{"单页", []pageSize{{1000, 800}}, []pyramidLevel{{0, 1000, 800}}},
+		{"逐层减半", []pageSize{{1000, 800}, {500, 400}, {250, 200}},
+			[]pyramidLevel{{0, 1000, 800}, {1, 500, 400}, {2, 250, 200}}},
+		{"奇数尺寸", []pageSize{{1001, 801}, {501, 401}, {251, 201}},
+			[]pyramidLevel{{0, 1001, 801}, {1, 501, 401}, {2, 251, 201}}},
+		{"宽高比不同的缩略图结束金字塔", []pageSize{{1000, 800}, {500, 400}, {100, 100}, {50, 40}},
+			[]pyramidLevel{{0, 1000, 800}, {1, 500, 400}}},
+		{"没有变小的页结束金字塔", []pageSize{{1000, 800}, {1000, 800}, {500, 400}},
+			[]pyramidLevel{{0, 1000, 800}}},
+	}
+	for _, tt := range tests {
+		got := pyramidLevelsFromPages(tt.pages)
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: 得到 %v，期望 %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPickPyramidLevel(t *testing.T) {
+	levels := []pyramidLevel{{0, 8000, 6000}, {1, 4000, 3000}, {2, 2000, 1500}, {3, 1000, 750}}
+	plan := &imagePlan{Width: 8000, Height: 6000}
+	tests := []struct {
+		shrink float64
+		page   int
+	}{
+		{1, 0}, {1.5, 0}, {2, 1}, {3.9, 1}, {4, 2}, {7.9, 2}, {8, 3}, {100, 3},
+	}
+	for _, tt := range tests {
+		if got := pickPyramidLevel(levels, plan, tt.shrink); got.Page != tt.page {
+			t.Errorf("shrink=%v: 选择第 %d 页，期望第 %d 页", tt.shrink, got.Page, tt.page)
+		}
+	}
+}
+
+func TestPlanImage(t *testing.T) {
+	// 8000x6000 的三层金字塔 TIFF，只有文件头，计划只依赖文件头
+	src := &sourceImage{
+		Identifier: "plan-test.tif",
+		Data:       probeTestTIFF(2, 1, [2]uint32{8000, 6000}, [2]uint32{4000, 3000}, [2]uint32{2000, 1500}),
+	}
+	tests := []struct {
+		region, size     string
+		x, y, w, h       int
+		targetW, targetH int
+		shrink           float64
+	}{
+		{"full", "max", 0, 0, 8000, 6000, 8000, 6000, 1},
+		{"full", "1000,", 0, 0, 8000, 6000, 1000, 750, 8},
+		{"pct:50,50,50,50", "1000,", 4000, 3000, 4000, 3000, 1000, 750, 4},
+		{"0,0,512,512", "256,", 0, 0, 512, 512, 256, 256, 2},
+		{"7900,5900,200,200", "max", 7900, 5900, 100, 100, 100, 100, 1},
+		{"square", "!600,600", 1000, 0, 6000, 6000, 600, 600, 10},
+	}
+	for _, tt := range tests {
+		req := IIIFRequest{Identifier: src.Identifier, Region: tt.region, Size: tt.size, Rotation: "0", Quality: "default", Format: "jpg"}
+		plan, err := planImage(src, req)
+		if err != nil {
+			t.Errorf("%s/%s: %v", tt.region, tt.size, err)
+			continue
+		}
+		if plan.Width != 8000 || plan.Height != 6000 || plan.Format != vips.ImageTypeTIFF || len(plan.Levels) != 3 {
+			t.Errorf("%s/%s: 原图信息错误: %+v", tt.region, tt.size, plan)
+		}
+		if plan.X != tt.x || plan.Y != tt.y || plan.W != tt.w || plan.H != tt.h ||
+			plan.TargetW != tt.targetW || plan.TargetH != tt.targetH || plan.shrink() != tt.shrink {
+			t.Errorf("%s/%s: 得到区域 %d,%d,%d,%d 输出 %dx%d 缩小 %v，期望 %d,%d,%d,%d 输出 %dx%d 缩小 %v",
+				tt.region, tt.size, plan.X, plan.Y, plan.W, plan.H, plan.TargetW, plan.TargetH, plan.shrink(),
+				tt.x, tt.y, tt.w, tt.h, tt.targetW, tt.targetH, tt.shrink)
+		}
+	}
+
+	for _, region := range []string{"8000,0,10,10", "pct:100,0,10,10"} {
+		req := IIIFRequest{Identifier: src.Identifier, Region: region, Size: "max", Rotation: "0", Quality: "default", Format: "jpg"}
+		if _, err := planImage(src, req); err == nil {
+			t.Errorf("%s: 区域在图像之外，应返回错误", region)
+		}
+	}
+}
+
+// 各种计划（JPEG shrink-on-load、金字塔选层、整图解码）解码后的尺寸都等于输出尺寸，本地路径和内存数据一致
+func TestDecodeForPlanSize(t *testing.T) {
+	img, err := gradientImage(3000, 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+
+	dir := t.TempDir()
+	sources := map[string]*sourceImage{}
+	for _, format := range []string{"jpg", "tif", "png"} {
+		var data []byte
+		switch format {
+		case "jpg":
+			data, _, err = img.ExportJpeg(vips.NewJpegExportParams())
+		case "tif":
+			data, _, err = img.ExportTiff(pyramidExportParams(img))
+		case "png":
+			data, _, err = img.ExportPng(vips.NewPngExportParams())
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		file := filepath.Join(dir, "decode."+format)
+		if err := os.WriteFile(file, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		sources[format+" 路径"] = &sourceImage{Identifier: file, Path: file}
+		sources[format+" 内存"] = &sourceImage{Identifier: file + "#data", Data: data}
+	}
+
+	requests := []struct{ region, size string }{
+		{"full", "max"},
+		{"full", "300,"},
+		{"full", "!500,500"},
+		{"pct:25,25,50,50", "200,"},
+		{"0,0,1024,1024", "256,"},
+		{"2900,1900,512,512", "max"},
+		{"1000,500,333,777", "100,"},
+		{"full", "^4000,"},
+	}
+	for name, src := range sources {
+		for _, r := range requests {
+			req := IIIFRequest{Identifier: src.Identifier, Region: r.region, Size: r.size, Rotation: "0", Quality: "default", Format: "jpg"}
+			plan, err := planImage(src, req)
+			if err != nil {
+				t.Errorf("%s %s/%s: %v", name, r.region, r.size, err)
+				continue
+			}
+			out, err := decodeForPlan(src, plan)
+			if err != nil {
+				t.Errorf("%s %s/%s: %v", name, r.region, r.size, err)
+				continue
+			}
+			if out.Width() != plan.TargetW || out.Height() != plan.TargetH {
+				t.Errorf("%s %s/%s: 得到 %dx%d，期望 %dx%d", name, r.region, r.size, out.Width(), out.Height(), plan.TargetW, plan.TargetH)
+			}
+			out.Close()
+		}
+	}
+}
+
+// 对比"全分辨率解码后裁剪缩放"与 shrink-on-load（JPEG 缩小解码、金字塔 TIFF 选层）处理同一请求的耗时：
+//
+//	go test -run '^$' -bench Decode -benchtime 10x
+//
+// 设置 IIIF_BENCH_IMAGE 可以使用真实的大图，默认生成 8000x6000 的测试图。
+
+const benchWidth, benchHeight = 8000, 6000
+
+func BenchmarkDecodeJPEG(b *testing.B) {
+	benchmarkDecode(b, benchSource(b, "jpg"), "full", "200,")
+}
+
+func BenchmarkDecodeJPEGRegion(b *testing.B) {
+	benchmarkDecode(b, benchSource(b, "jpg"), "pct:25,25,50,50", "512,")
+}
+
+func BenchmarkDecodePyramidTIFF(b *testing.B) {
+	benchmarkDecode(b, benchSource(b, "tif"), "full", "200,")
+}
+
+func BenchmarkDecodePyramidTIFFTile(b *testing.B) {
+	benchmarkDecode(b, benchSource(b, "tif"), "0,0,4096,4096", "512,")
+}
+
+func benchmarkDecode(b *testing.B, src *sourceImage, region, size string) {
+	req := IIIFRequest{Identifier: src.Path, Region: region, Size: size, Rotation: "0", Quality: "default", Format: "jpg"}
+	plan, err := planImage(src, req)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	// 对照组：解码全部像素后再裁剪缩放
+	b.Run("full-decode", func(b *testing.B) {
+		benchmarkLoad(b, func() (*vips.ImageRef, error) {
+			img, err := src.decode(nil)
+			if err != nil {
+				return nil, err
+			}
+			return img, cropAndResize(img, plan)
+		})
+	})
+	// 实验组：按计划 shrink-on-load / 选择金字塔层级
+	b.Run("shrink-on-load", func(b *testing.B) {
+		benchmarkLoad(b, func() (*vips.ImageRef, error) {
+			return decodeForPlan(src, plan)
+		})
+	})
+}
+
+// 导出为 JPEG 以强制 libvips 真正计算像素
+func benchmarkLoad(b *testing.B, load func() (*vips.ImageRef, error)) {
+	for i := 0; i < b.N; i++ {
+		img, err := load()
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, _, err = img.ExportJpeg(vips.NewJpegExportParams())
+		img.Close()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// 测试原图：IIIF_BENCH_IMAGE 指定的文件，或生成带渐变的大图（tif 为分块金字塔）
+func benchSource(b *testing.B, format string) *sourceImage {
+	b.Helper()
+	img, err := benchImage()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer img.Close()
+
+	var data []byte
+	if format == "tif" {
+		data, _, err = img.ExportTiff(pyramidExportParams(img))
+	} else {
+		data, _, err = img.ExportJpeg(vips.NewJpegExportParams())
+	}
+	if err != nil {
+		b.Fatal(err)
+	}
+	file := filepath.Join(b.TempDir(), "bench."+format)
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		b.Fatal(err)
+	}
+	return &sourceImage{Identifier: file, Path: file}
+}
+
+func benchImage() (*vips.ImageRef, error) {
+	if file := os.Getenv("IIIF_BENCH_IMAGE"); file != "" {
+		return vips.NewImageFromFile(file)
+	}
+	return gradientImage(benchWidth, benchHeight)
+}
+
+// 横纵坐标映射为 0-255 渐变的三通道测试图
+func gradientImage(width, height int) (*vips.ImageRef, error) {
+	img, err := vips.XYZ(width, height)
+	if err != nil {
+		return nil, err
+	}
+	if err := img.Linear([]float64{255.0 / float64(width), 255.0 / float64(height)}, []float64{0, 0}); err != nil {
+		img.Close()
+		return nil, err
+	}
+	if err := img.Cast(vips.BandFormatUchar); err != nil {
+		img.Close()
+		return nil, err
+	}
+	first, err := img.ExtractBandToImage(0, 1)
+	if err != nil {
+		img.Close()
+		return nil, err
+	}
+	defer first.Close()
+	if err := img.BandJoin(first); err != nil {
+		img.Close()
+		return nil, err
+	}
+	return img, nil
+}
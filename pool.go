@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/davidbyttow/govips/v2/vips"
+	"github.com/gin-gonic/gin"
+)
+
+// 图像处理并发控制配置（处理槽位数量由顶层 concurrency 决定）
+type ProcessingConfig struct {
+	QueueLength int `yaml:"queueLength"` // 等待处理槽位的请求数上限，超过直接返回503
+	WaitTimeout int `yaml:"waitTimeout"` // 等待处理槽位的超时时间，单位为毫秒
+	RetryAfter  int `yaml:"retryAfter"`  // 503 响应的 Retry-After，单位为秒
+}
+
+// libvips 运行参数，0 表示使用 libvips 默认值
+type VipsConfig struct {
+	ConcurrencyLevel int `yaml:"concurrencyLevel"` // 单个操作内部的线程数
+	MaxCacheMem      int `yaml:"maxCacheMem"`      // 操作缓存最大内存(字节)
+	MaxCacheSize     int `yaml:"maxCacheSize"`     // 操作缓存最大操作数
+	MaxCacheFiles    int `yaml:"maxCacheFiles"`    // 操作缓存最大打开文件数
+}
+
+// 处理槽位已满且等待队列已满或等待超时
+var errPoolSaturated = errors.New("服务器繁忙，请稍后重试")
+
+// 有界的 libvips 处理池：最多 size 个请求同时处理，最多 maxQueue 个请求排队等待
+type workerPool struct {
+	slots    chan struct{}
+	maxQueue int64
+	timeout  time.Duration
+
+	waiting atomic.Int64
+}
+
+// 处理池统计信息
+type PoolStats struct {
+	Size    int   `json:"size"`
+	Active  int   `json:"active"`
+	Waiting int64 `json:"waiting"`
+}
+
+var processingPool *workerPool
+
+func initProcessingPool() {
+	size := config.Concurrency
+	if size <= 0 {
+		size = runtime.NumCPU()
+	}
+	queue := config.Processing.QueueLength
+	if queue <= 0 {
+		queue = size * 16
+	}
+	timeout := 10 * time.Second
+	if config.Processing.WaitTimeout > 0 {
+		timeout = time.Duration(config.Processing.WaitTimeout) * time.Millisecond
+	}
+	processingPool = &workerPool{
+		slots:    make(chan struct{}, size),
+		maxQueue: int64(queue),
+		timeout:  timeout,
+	}
+}
+
+// 获取处理槽位，成功时返回释放函数
+func (p *workerPool) Acquire(ctx context.Context) (func(), error) {
+	release := func() { <-p.slots }
+
+	select {
+	case p.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	if p.waiting.Add(1) > p.maxQueue {
+		p.waiting.Add(-1)
+		return nil, errPoolSaturated
+	}
+	defer p.waiting.Add(-1)
+
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+	select {
+	case p.slots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, errPoolSaturated
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// 后台任务获取处理槽位：不占用请求的等待队列，也不超时，一直等到有空闲槽位或 ctx 结束
+func (p *workerPool) AcquireBackground(ctx context.Context) (func(), error) {
+	select {
+	case p.slots <- struct{}{}:
+		return func() { <-p.slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (p *workerPool) Stats() PoolStats {
+	return PoolStats{Size: cap(p.slots), Active: len(p.slots), Waiting: p.waiting.Load()}
+}
+
+// 503 响应的 Retry-After 秒数
+func retryAfterSeconds() int {
+	if config.Processing.RetryAfter > 0 {
+		return config.Processing.RetryAfter
+	}
+	return 1
+}
+
+// 获取处理槽位失败时返回 503 + Retry-After
+func sendBusyError(c *gin.Context, err error) {
+	c.Header("Retry-After", strconv.Itoa(retryAfterSeconds()))
+	sendIIIFError(c, 503, "ServiceUnavailable", err.Error())
+}
+
+// 转换为 vips.Startup 参数，未配置的项交给 govips 使用默认值
+func vipsStartupConfig() *vips.Config {
+	orDefault := func(v int) int {
+		if v <= 0 {
+			return -1
+		}
+		return v
+	}
+	return &vips.Config{
+		ConcurrencyLevel: orDefault(config.Vips.ConcurrencyLevel),
+		MaxCacheMem:      orDefault(config.Vips.MaxCacheMem),
+		MaxCacheSize:     orDefault(config.Vips.MaxCacheSize),
+		MaxCacheFiles:    orDefault(config.Vips.MaxCacheFiles),
+	}
+}
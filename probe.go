@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// 只读取文件头即可确定的图像元数据
+type probeResult struct {
+	Width  int
+	Height int
+	Bands  int
+	Format vips.ImageType
+	Pages  int
+
+	Orientation int  // EXIF/TIFF 方向标签，0 表示没有
+	CMYK        bool // CMYK 图像（4 分量 JPEG、PhotometricInterpretation=5 的 TIFF）
+
+	PageSizes []pageSize // 多页 TIFF 各页尺寸，用于识别金字塔层级
+}
+
+type pageSize struct {
+	Width, Height int
+}
+
+var errProbeUnsupported = errors.New("无法仅通过文件头识别图像")
+
+const (
+	probeBlockSize = 64 << 10 // 每次读取（MinIO 范围请求）的块大小
+	probeMaxBytes  = 8 << 20  // 最多读取的字节数，超过后交给 libvips
+)
+
+// 按块读取并缓存的随机访问读取器：每个块是一次有界的 ReadAt（本地文件 pread，MinIO 对象为
+// 只请求该块的范围 GET）
+type probeReader struct {
+	r      io.ReaderAt
+	blocks map[int64][]byte
+	read   int64
+}
+
+func newProbeReader(r io.ReaderAt) *probeReader {
+	return &probeReader{r: r, blocks: map[int64][]byte{}}
+}
+
+func (pr *probeReader) block(index int64) ([]byte, error) {
+	if b, ok := pr.blocks[index]; ok {
+		return b, nil
+	}
+	if pr.read >= probeMaxBytes {
+		return nil, errProbeUnsupported
+	}
+	b := make([]byte, probeBlockSize)
+	n, err := pr.r.ReadAt(b, index*probeBlockSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	b = b[:n]
+	pr.blocks[index] = b
+	pr.read += int64(n)
+	return b, nil
+}
+
+// 读取 [off, off+n) 的字节，不足时返回 io.ErrUnexpectedEOF
+func (pr *probeReader) at(off int64, n int) ([]byte, error) {
+	if off < 0 || n < 0 {
+		return nil, errProbeUnsupported
+	}
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		pos := off + int64(len(out))
+		b, err := pr.block(pos / probeBlockSize)
+		if err != nil {
+			return nil, err
+		}
+		start := int(pos % probeBlockSize)
+		if start >= len(b) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		end := start + n - len(out)
+		if end > len(b) {
+			end = len(b)
+		}
+		out = append(out, b[start:end]...)
+	}
+	return out, nil
+}
+
+// 根据文件头识别格式并读取元数据
+func probeImage(r io.ReaderAt) (probeResult, error) {
+	pr := newProbeReader(r)
+	head, err := pr.at(0, 16)
+	if err != nil {
+		return probeResult{}, errProbeUnsupported
+	}
+
+	switch {
+	case bytes.HasPrefix(head, []byte{0xFF, 0xD8}):
+		return probeJPEG(pr)
+	case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")):
+		return probePNG(pr)
+	case bytes.HasPrefix(head, []byte("II*\x00")):
+		return probeTIFF(pr, binary.LittleEndian)
+	case bytes.HasPrefix(head, []byte("MM\x00*")):
+		return probeTIFF(pr, binary.BigEndian)
+	case bytes.HasPrefix(head, []byte("RIFF")) && bytes.Equal(head[8:12], []byte("WEBP")):
+		return probeWebP(pr)
+	case bytes.HasPrefix(head, []byte{0x00, 0x00, 0x00, 0x0C, 'j', 'P', ' ', ' ', 0x0D, 0x0A, 0x87, 0x0A}):
+		return probeJP2(pr)
+	case bytes.HasPrefix(head, []byte{0xFF, 0x4F, 0xFF, 0x51}):
+		return probeJ2KCodestream(pr, 0)
+	}
+	return probeResult{}, errProbeUnsupported
+}
+
+// JPEG：跳过各个段，直到帧头 SOFn，途中读取 APP1 中的 EXIF 方向
+func probeJPEG(pr *probeReader) (probeResult, error) {
+	off := int64(2)
+	orientation := 0
+	for {
+		b, err := pr.at(off, 2)
+		if err != nil {
+			return probeResult{}, errProbeUnsupported
+		}
+		if b[0] != 0xFF {
+			return probeResult{}, errProbeUnsupported
+		}
+		marker := b[1]
+		off += 2
+		switch {
+		case marker == 0xFF: // 填充字节
+			off--
+			continue
+		case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7): // 无长度的标记
+			continue
+		case marker == 0xD9 || marker == 0xDA: // EOI / SOS 之前必须出现 SOF
+			return probeResult{}, errProbeUnsupported
+		}
+
+		lb, err := pr.at(off, 2)
+		if err != nil {
+			return probeResult{}, errProbeUnsupported
+		}
+		length := int64(binary.BigEndian.Uint16(lb))
+		if length < 2 {
+			return probeResult{}, errProbeUnsupported
+		}
+		isSOF := marker >= 0xC0 && marker <= 0xCF && marker != 0xC4 && marker != 0xC8 && marker != 0xCC
+		if isSOF {
+			sof, err := pr.at(off+2, 6)
+			if err != nil {
+				return probeResult{}, errProbeUnsupported
+			}
+			return probeResult{
+				Height:      int(binary.BigEndian.Uint16(sof[1:3])),
+				Width:       int(binary.BigEndian.Uint16(sof[3:5])),
+				Bands:       int(sof[5]),
+				Format:      vips.ImageTypeJPEG,
+				Pages:       1,
+				Orientation: orientation,
+				CMYK:        sof[5] == 4,
+			}, nil
+		}
+		if marker == 0xE1 && orientation == 0 {
+			if app1, err := pr.at(off+2, int(length-2)); err == nil {
+				orientation = exifOrientation(app1)
+			}
+		}
+		off += length
+	}
+}
+
+// APP1 段中 EXIF 的方向标签（0x0112），没有时返回 0
+func exifOrientation(app1 []byte) int {
+	if len(app1) < 14 || !bytes.HasPrefix(app1, []byte("Exif\x00\x00")) {
+		return 0
+	}
+	tiff := app1[6:]
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		e := ifd + 2 + i*12
+		if e+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[e:]) == 0x0112 && order.Uint16(tiff[e+2:]) == 3 {
+			return int(order.Uint16(tiff[e+8:]))
+		}
+	}
+	return 0
+}
+
+// PNG：IHDR 必须是第一个块
+func probePNG(pr *probeReader) (probeResult, error) {
+	b, err := pr.at(8, 8+13)
+	if err != nil || !bytes.Equal(b[4:8], []byte("IHDR")) {
+		return probeResult{}, errProbeUnsupported
+	}
+	ihdr := b[8:]
+	bands := 0
+	switch ihdr[9] { // 颜色类型
+	case 0:
+		bands = 1
+	case 2, 3:
+		bands = 3
+	case 4:
+		bands = 2
+	case 6:
+		bands = 4
+	default:
+		return probeResult{}, errProbeUnsupported
+	}
+	return probeResult{
+		Width:  int(binary.BigEndian.Uint32(ihdr[0:4])),
+		Height: int(binary.BigEndian.Uint32(ihdr[4:8])),
+		Bands:  bands,
+		Format: vips.ImageTypePNG,
+		Pages:  1,
+	}, nil
+}
+
+// TIFF：读取第一个 IFD 的通道数、色彩空间和方向，并沿 IFD 链读取每一页的尺寸
+func probeTIFF(pr *probeReader, order binary.ByteOrder) (probeResult, error) {
+	b, err := pr.at(4, 4)
+	if err != nil {
+		return probeResult{}, errProbeUnsupported
+	}
+	res := probeResult{Bands: 1, Format: vips.ImageTypeTIFF}
+	ifd := int64(order.Uint32(b))
+	seen := map[int64]bool{}
+	for ifd != 0 && !seen[ifd] && res.Pages < 10000 {
+		seen[ifd] = true
+		cb, err := pr.at(ifd, 2)
+		if err != nil {
+			return probeResult{}, errProbeUnsupported
+		}
+		count := int(order.Uint16(cb))
+		entries, err := pr.at(ifd+2, count*12+4)
+		if err != nil {
+			return probeResult{}, errProbeUnsupported
+		}
+		var page pageSize
+		for i := 0; i < count; i++ {
+			e := entries[i*12 : i*12+12]
+			tag, typ := order.Uint16(e[0:2]), order.Uint16(e[2:4])
+			var value int
+			switch typ {
+			case 3: // SHORT
+				value = int(order.Uint16(e[8:10]))
+			case 4: // LONG
+				value = int(order.Uint32(e[8:12]))
+			default:
+				continue
+			}
+			switch tag {
+			case 256:
+				page.Width = value
+			case 257:
+				page.Height = value
+			case 277:
+				if res.Pages == 0 {
+					res.Bands = value
+				}
+			case 262: // PhotometricInterpretation
+				if res.Pages == 0 {
+					res.CMYK = value == 5
+				}
+			case 274: // Orientation
+				if res.Pages == 0 {
+					res.Orientation = value
+				}
+			}
+		}
+		if res.Pages == 0 {
+			res.Width, res.Height = page.Width, page.Height
+		}
+		res.PageSizes = append(res.PageSizes, page)
+		res.Pages++
+		ifd = int64(order.Uint32(entries[count*12:]))
+	}
+	if res.Width <= 0 || res.Height <= 0 {
+		return probeResult{}, errProbeUnsupported
+	}
+	return res, nil
+}
+
+// WebP：VP8 / VP8L / VP8X 三种文件头，动画 WebP 交给 libvips
+func probeWebP(pr *probeReader) (probeResult, error) {
+	b, err := pr.at(12, 18)
+	if err != nil {
+		return probeResult{}, errProbeUnsupported
+	}
+	chunk, data := string(b[0:4]), b[8:]
+	res := probeResult{Bands: 3, Format: vips.ImageTypeWEBP, Pages: 1}
+	switch chunk {
+	case "VP8 ":
+		if !bytes.Equal(data[3:6], []byte{0x9D, 0x01, 0x2A}) {
+			return probeResult{}, errProbeUnsupported
+		}
+		res.Width = int(binary.LittleEndian.Uint16(data[6:8]) & 0x3FFF)
+		res.Height = int(binary.LittleEndian.Uint16(data[8:10]) & 0x3FFF)
+	case "VP8L":
+		if data[0] != 0x2F {
+			return probeResult{}, errProbeUnsupported
+		}
+		bits := binary.LittleEndian.Uint32(data[1:5])
+		res.Width = int(bits&0x3FFF) + 1
+		res.Height = int((bits>>14)&0x3FFF) + 1
+		if bits&(1<<28) != 0 {
+			res.Bands = 4
+		}
+	case "VP8X":
+		flags := data[0]
+		if flags&0x02 != 0 { // 动画
+			return probeResult{}, errProbeUnsupported
+		}
+		if flags&0x10 != 0 {
+			res.Bands = 4
+		}
+		res.Width = int(uint32(data[4])|uint32(data[5])<<8|uint32(data[6])<<16) + 1
+		res.Height = int(uint32(data[7])|uint32(data[8])<<8|uint32(data[9])<<16) + 1
+	default:
+		return probeResult{}, errProbeUnsupported
+	}
+	return res, nil
+}
+
+// JP2：在 jp2h 盒中查找 ihdr 盒
+func probeJP2(pr *probeReader) (probeResult, error) {
+	off := int64(12)
+	end := int64(-1)
+	for i := 0; i < 64; i++ {
+		hdr, err := pr.at(off, 8)
+		if err != nil {
+			return probeResult{}, errProbeUnsupported
+		}
+		length := int64(binary.BigEndian.Uint32(hdr[0:4]))
+		boxType := string(hdr[4:8])
+		headerLen := int64(8)
+		if length == 1 {
+			xl, err := pr.at(off+8, 8)
+			if err != nil {
+				return probeResult{}, errProbeUnsupported
+			}
+			length = int64(binary.BigEndian.Uint64(xl))
+			headerLen = 16
+		}
+
+		switch boxType {
+		case "jp2h":
+			// 进入超级盒，依次读取其中的子盒
+			end = off + length
+			off += headerLen
+			continue
+		case "ihdr":
+			b, err := pr.at(off+headerLen, 10)
+			if err != nil {
+				return probeResult{}, errProbeUnsupported
+			}
+			return probeResult{
+				Height: int(binary.BigEndian.Uint32(b[0:4])),
+				Width:  int(binary.BigEndian.Uint32(b[4:8])),
+				Bands:  int(binary.BigEndian.Uint16(b[8:10])),
+				Format: vips.ImageTypeJP2K,
+				Pages:  1,
+			}, nil
+		case "jp2c":
+			return probeJ2KCodestream(pr, off+headerLen)
+		}
+		if length == 0 || (end > 0 && off+length > end) {
+			return probeResult{}, errProbeUnsupported
+		}
+		off += length
+	}
+	return probeResult{}, errProbeUnsupported
+}
+
+// J2K 码流：SIZ 段紧跟在 SOC 之后
+func probeJ2KCodestream(pr *probeReader, off int64) (probeResult, error) {
+	b, err := pr.at(off, 42)
+	if err != nil || b[0] != 0xFF || b[1] != 0x4F || b[2] != 0xFF || b[3] != 0x51 {
+		return probeResult{}, errProbeUnsupported
+	}
+	siz := b[6:] // 跳过 SOC、SIZ 标记和 Lsiz
+	xsiz, ysiz := binary.BigEndian.Uint32(siz[2:6]), binary.BigEndian.Uint32(siz[6:10])
+	xo, yo := binary.BigEndian.Uint32(siz[10:14]), binary.BigEndian.Uint32(siz[14:18])
+	if xsiz <= xo || ysiz <= yo {
+		return probeResult{}, errProbeUnsupported
+	}
+	return probeResult{
+		Width:  int(xsiz - xo),
+		Height: int(ysiz - yo),
+		Bands:  int(binary.BigEndian.Uint16(siz[34:36])),
+		Format: vips.ImageTypeJP2K,
+		Pages:  1,
+	}, nil
+}
+
+// 只读取已解析原图的文件头获取图像元数据，失败时返回错误由调用方回退到 libvips
+func probeSource(ctx context.Context, resolved resolvedImage) (imageDims, error) {
+	r, err := resolved.Source.Open(ctx, resolved.Info.Key)
+	if err != nil {
+		return imageDims{}, err
+	}
+	defer r.Close()
+
+	ra, ok := r.(io.ReaderAt)
+	if !ok {
+		return imageDims{}, fmt.Errorf("探测 %s 失败: %w", resolved.Info.Key, errProbeUnsupported)
+	}
+	res, err := probeImage(ra)
+	if err != nil {
+		return imageDims{}, fmt.Errorf("探测 %s 失败: %w", resolved.Info.Key, err)
+	}
+	return dimsFromProbe(res), nil
+}
+
+func dimsFromProbe(res probeResult) imageDims {
+	dims := imageDims{
+		Width:  res.Width,
+		Height: res.Height,
+		Bands:  res.Bands,
+		Format: vips.ImageTypes[res.Format],
+		Pages:  res.Pages,
+
+		Orientation: res.Orientation,
+		CMYK:        res.CMYK,
+	}
+	if len(res.PageSizes) > 1 {
+		dims.Levels = pyramidLevelsFromPages(res.PageSizes)
+	}
+	return dims
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// 只有文件头的 JPEG：可选的 EXIF 方向和 SOF0 帧头
+func probeTestJPEG(orientation, components int) []byte {
+	var b bytes.Buffer
+	b.Write([]byte{0xFF, 0xD8})
+	if orientation > 0 {
+		var exif bytes.Buffer
+		exif.WriteString("Exif\x00\x00MM\x00*")
+		binary.Write(&exif, binary.BigEndian, uint32(8))
+		binary.Write(&exif, binary.BigEndian, uint16(1))
+		binary.Write(&exif, binary.BigEndian, []uint16{0x0112, 3})
+		binary.Write(&exif, binary.BigEndian, uint32(1))
+		binary.Write(&exif, binary.BigEndian, []uint16{uint16(orientation), 0})
+		binary.Write(&exif, binary.BigEndian, uint32(0))
+		b.Write([]byte{0xFF, 0xE1})
+		binary.Write(&b, binary.BigEndian, uint16(exif.Len()+2))
+		b.Write(exif.Bytes())
+	}
+	b.Write([]byte{0xFF, 0xC0})
+	binary.Write(&b, binary.BigEndian, uint16(8+3*components))
+	b.WriteByte(8)
+	binary.Write(&b, binary.BigEndian, []uint16{600, 800})
+	b.WriteByte(byte(components))
+	b.Write(make([]byte, 3*components))
+	return b.Bytes()
+}
+
+// 只有 IFD 链的小端 TIFF，每页为 {宽, 高}，第一页带色彩空间和方向
+func probeTestTIFF(photometric, orientation int, pages ...[2]uint32) []byte {
+	var b bytes.Buffer
+	b.WriteString("II*\x00")
+	binary.Write(&b, binary.LittleEndian, uint32(8))
+	for i, p := range pages {
+		entries := [][3]uint32{{256, 4, p[0]}, {257, 4, p[1]}, {277, 3, 3}}
+		if i == 0 {
+			entries = append(entries, [3]uint32{262, 3, uint32(photometric)}, [3]uint32{274, 3, uint32(orientation)})
+		}
+		binary.Write(&b, binary.LittleEndian, uint16(len(entries)))
+		for _, e := range entries {
+			binary.Write(&b, binary.LittleEndian, []uint16{uint16(e[0]), uint16(e[1])})
+			binary.Write(&b, binary.LittleEndian, uint32(1))
+			binary.Write(&b, binary.LittleEndian, e[2])
+		}
+		next := uint32(0)
+		if i < len(pages)-1 {
+			next = uint32(b.Len() + 4)
+		}
+		binary.Write(&b, binary.LittleEndian, next)
+	}
+	return b.Bytes()
+}
+
+func TestProbeImage(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want imageDims
+	}{
+		{"JPEG", probeTestJPEG(0, 3), imageDims{Width: 800, Height: 600, Bands: 3, Format: "jpeg", Pages: 1}},
+		{"JPEG EXIF 方向", probeTestJPEG(6, 3), imageDims{Width: 800, Height: 600, Bands: 3, Format: "jpeg", Pages: 1, Orientation: 6}},
+		{"CMYK JPEG", probeTestJPEG(1, 4), imageDims{Width: 800, Height: 600, Bands: 4, Format: "jpeg", Pages: 1, Orientation: 1, CMYK: true}},
+		{"TIFF", probeTestTIFF(2, 1, [2]uint32{800, 600}), imageDims{Width: 800, Height: 600, Bands: 3, Format: "tiff", Pages: 1, Orientation: 1}},
+		{"CMYK TIFF", probeTestTIFF(5, 8, [2]uint32{800, 600}), imageDims{Width: 800, Height: 600, Bands: 3, Format: "tiff", Pages: 1, Orientation: 8, CMYK: true}},
+	}
+	for _, tt := range tests {
+		res, err := probeImage(bytes.NewReader(tt.data))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		got := dimsFromProbe(res)
+		if got.Width != tt.want.Width || got.Height != tt.want.Height || got.Bands != tt.want.Bands ||
+			got.Format != tt.want.Format || got.Pages != tt.want.Pages ||
+			got.Orientation != tt.want.Orientation || got.CMYK != tt.want.CMYK || len(got.Levels) != 0 {
+			t.Errorf("%s: 得到 %+v，期望 %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// 记录每次 ReadAt 的范围
+type countingReaderAt struct {
+	r     io.ReaderAt
+	reads [][2]int64
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	c.reads = append(c.reads, [2]int64{off, int64(len(p))})
+	return c.r.ReadAt(p, off)
+}
+
+// 探测只发出有界的块读取，不读取整个文件
+func TestProbeBoundedReads(t *testing.T) {
+	data := append(probeTestJPEG(6, 3), make([]byte, 4*probeBlockSize)...)
+	r := &countingReaderAt{r: bytes.NewReader(data)}
+	if _, err := probeImage(r); err != nil {
+		t.Fatal(err)
+	}
+	for _, read := range r.reads {
+		if read[1] > probeBlockSize || read[0]%probeBlockSize != 0 {
+			t.Errorf("读取范围 [%d, +%d) 不是单个块", read[0], read[1])
+		}
+	}
+	if len(r.reads) != 1 {
+		t.Errorf("读取了 %d 个块，期望 1 个", len(r.reads))
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// 金字塔TIFF配置
+type PyramidConfig struct {
+	Suffix        string `yaml:"suffix"`        // 与原图并存时追加的后缀，默认 .ptif（a/b.jpg -> a/b.jpg.ptif）
+	PreferPyramid bool   `yaml:"preferPyramid"` // 请求时优先使用同名金字塔TIFF
+	AutoConvert   bool   `yaml:"autoConvert"`   // 首次访问非金字塔大图时在后台自动转换（入库钩子）
+	MinPixels     int    `yaml:"minPixels"`     // 自动转换的最小像素数
+	TileSize      int    `yaml:"tileSize"`      // 分块大小，默认256
+	Compression   string `yaml:"compression"`   // jpeg | deflate | lzw | zstd | webp | none，默认 jpeg
+	Quality       int    `yaml:"quality"`       // jpeg/webp 压缩质量，默认85
+}
+
+func pyramidSuffix() string {
+	if config.Pyramid.Suffix != "" {
+		return config.Pyramid.Suffix
+	}
+	return ".ptif"
+}
+
+// 原图对应的金字塔TIFF键
+func pyramidKey(key string) string {
+	return key + pyramidSuffix()
+}
+
+// 查找与原图并存的金字塔TIFF
+func statPyramid(ctx context.Context, src ImageSource, key string) (SourceInfo, bool) {
+	if !config.Pyramid.PreferPyramid || strings.HasSuffix(key, pyramidSuffix()) {
+		return SourceInfo{}, false
+	}
+	info, err := src.Stat(ctx, pyramidKey(key))
+	if err != nil {
+		return SourceInfo{}, false
+	}
+	return info, true
+}
+
+// 金字塔TIFF导出参数
+func pyramidExportParams(img *vips.ImageRef) *vips.TiffExportParams {
+	cfg := config.Pyramid
+	params := vips.NewTiffExportParams()
+	params.Tile = true
+	params.Pyramid = true
+	params.TileWidth, params.TileHeight = 256, 256
+	if cfg.TileSize > 0 {
+		params.TileWidth, params.TileHeight = cfg.TileSize, cfg.TileSize
+	}
+	params.Quality = 85
+	if cfg.Quality > 0 {
+		params.Quality = cfg.Quality
+	}
+
+	params.Compression, _ = parseTiffCompression(cfg.Compression)
+	// JPEG 压缩只支持 8 位且不带透明通道的图像
+	if params.Compression == vips.TiffCompressionJpeg &&
+		(img.HasAlpha() || img.BandFormat() != vips.BandFormatUchar) {
+		params.Compression = vips.TiffCompressionDeflate
+	}
+	return params
+}
+
+// 将图片源中的对象转换为分块金字塔TIFF并写入 dstKey
+func convertToPyramid(ctx context.Context, src ImageSource, key, dstKey string) error {
+	dst, ok := src.(WritableSource)
+	if !ok {
+		return fmt.Errorf("图片源不支持写入")
+	}
+
+	info, err := src.Stat(ctx, key)
+	if err != nil {
+		return err
+	}
+	var img *vips.ImageRef
+	if info.Path != "" {
+		img, err = vips.NewImageFromFile(info.Path)
+	} else {
+		var object io.ReadSeekCloser
+		object, err = src.Open(ctx, key)
+		if err != nil {
+			return err
+		}
+		img, err = vips.NewImageFromReader(object)
+		object.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("读取图像错误: %v", err)
+	}
+	defer img.Close()
+
+	// 先写入临时文件再放入图片源：本地源在同一目录内重命名，MinIO 从文件分片上传
+	dir := os.TempDir()
+	if info.Path != "" {
+		dir = filepath.Dir(info.Path)
+	}
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(dstKey)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("创建临时文件失败: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	start := time.Now()
+	size, err := exportPyramidFile(img, tmp)
+	if err != nil {
+		return err
+	}
+	if err := dst.PutFile(ctx, dstKey, tmp.Name()); err != nil {
+		return err
+	}
+	log.Printf("✅ 金字塔TIFF转换完成: %s -> %s (%dx%d, %d bytes, 耗时 %v)",
+		key, dstKey, img.Width(), img.Height(), size, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// 导出金字塔TIFF到临时文件。govips 只能导出到内存，写入文件后即释放，不随上传过程常驻内存
+func exportPyramidFile(img *vips.ImageRef, f *os.File) (int64, error) {
+	data, _, err := img.ExportTiff(pyramidExportParams(img))
+	if err != nil {
+		f.Close()
+		return 0, fmt.Errorf("导出金字塔TIFF失败: %v", err)
+	}
+	n, err := f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("写入临时文件失败: %v", err)
+	}
+	return int64(n), nil
+}
+
+var pyramidConversions sync.Map // key: 源对象键, 排队或正在转换中的对象
+
+// 后台转换队列：由单个 worker 依次转换，每次转换持有一个处理槽位，与请求共享 libvips 并发上限。
+// 队列满时放弃本次调度，之后的请求会再次尝试
+const pyramidQueueLength = 64
+
+type pyramidJob struct {
+	source ImageSource
+	key    string
+}
+
+var (
+	pyramidQueue     chan pyramidJob
+	pyramidQueueOnce sync.Once
+)
+
+func enqueuePyramid(job pyramidJob) bool {
+	pyramidQueueOnce.Do(func() {
+		pyramidQueue = make(chan pyramidJob, pyramidQueueLength)
+		go runPyramidQueue()
+	})
+	select {
+	case pyramidQueue <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+func runPyramidQueue() {
+	for job := range pyramidQueue {
+		runPyramidJob(job)
+	}
+}
+
+func runPyramidJob(job pyramidJob) {
+	defer pyramidConversions.Delete(job.key)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+	release, err := processingPool.AcquireBackground(ctx)
+	if err != nil {
+		log.Printf("后台金字塔转换失败: %s: %v", job.key, err)
+		return
+	}
+	defer release()
+	if err := convertToPyramid(ctx, job.source, job.key, pyramidKey(job.key)); err != nil {
+		log.Printf("后台金字塔转换失败: %s: %v", job.key, err)
+	}
+}
+
+// 已判断过是否需要转换的源版本（键@版本），每个版本只检查一次
+var (
+	pyramidCheckedMu sync.Mutex
+	pyramidChecked   = map[string]struct{}{}
+)
+
+const maxPyramidChecked = 100000
+
+// 标记源版本已检查，返回 false 表示之前已检查过。超过上限时整体清空，最坏只是多检查一次
+func markPyramidChecked(version string) bool {
+	pyramidCheckedMu.Lock()
+	defer pyramidCheckedMu.Unlock()
+	if _, ok := pyramidChecked[version]; ok {
+		return false
+	}
+	if len(pyramidChecked) >= maxPyramidChecked {
+		pyramidChecked = map[string]struct{}{}
+	}
+	pyramidChecked[version] = struct{}{}
+	return true
+}
+
+// 取消检查标记，转换未能排队时让之后的请求重新调度
+func unmarkPyramidChecked(version string) {
+	pyramidCheckedMu.Lock()
+	defer pyramidCheckedMu.Unlock()
+	delete(pyramidChecked, version)
+}
+
+// 入库钩子：请求到非金字塔大图时在后台转换，转换完成后的请求会自动使用金字塔TIFF
+func maybeSchedulePyramid(src *sourceImage, plan *imagePlan) {
+	cfg := config.Pyramid
+	if !cfg.AutoConvert || src.Source == nil || src.Info.Key == "" {
+		return
+	}
+	if strings.HasSuffix(src.Info.Key, pyramidSuffix()) || plan.Width*plan.Height < cfg.MinPixels {
+		return
+	}
+	if _, ok := src.Source.(WritableSource); !ok {
+		return
+	}
+	key := src.Info.Key
+	version := key + "@" + sourceVersion(src.Info)
+	if !markPyramidChecked(version) {
+		return
+	}
+	// 层级来自按版本缓存的头部信息；已是金字塔或已有同名金字塔TIFF（preferPyramid 关闭时）不再转换
+	if len(plan.Levels) > 1 {
+		return
+	}
+	if _, err := src.Source.Stat(context.Background(), pyramidKey(key)); err == nil {
+		return
+	}
+
+	if _, running := pyramidConversions.LoadOrStore(key, struct{}{}); running {
+		return
+	}
+	if !enqueuePyramid(pyramidJob{source: src.Source, key: key}) {
+		pyramidConversions.Delete(key)
+		unmarkPyramidChecked(version)
+		log.Printf("警告: 后台金字塔转换队列已满，跳过: %s", key)
+	}
+}
+
+// convert 子命令：将原图转换为分块金字塔TIFF
+//
+//	iiif-server convert [-source local] [-inplace] [-prefix dir/] [对象键...]
+func runConvert(args []string) error {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	sourceName := fs.String("source", defaultSourceName(), "图片源名称")
+	inPlace := fs.Bool("inplace", false, "覆盖原图，而不是写入同名 "+pyramidSuffix()+" 文件")
+	prefix := fs.String("prefix", "", "转换该前缀下的所有对象")
+	fs.Parse(args)
+
+	src, err := getSource(*sourceName)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	keys := fs.Args()
+	if *prefix != "" {
+		listed, err := src.List(ctx, *prefix)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, listed...)
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("请指定对象键或 -prefix")
+	}
+
+	failed := 0
+	for _, key := range keys {
+		if strings.HasSuffix(key, pyramidSuffix()) {
+			continue
+		}
+		dstKey := pyramidKey(key)
+		if *inPlace {
+			dstKey = key
+		}
+		if err := convertToPyramid(ctx, src, key, dstKey); err != nil {
+			log.Printf("❌ 转换失败: %s: %v", key, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d 个对象转换失败", failed)
+	}
+	return nil
+}
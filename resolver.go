@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+)
+
+// 标识符解析规则（config.yaml 中 resolvers 下的每一项，按顺序匹配）
+type ResolverRule struct {
+	Prefix string `yaml:"prefix"` // 按标识符前缀匹配
+	Regex  string `yaml:"regex"`  // 按正则匹配（与 prefix 二选一）
+	Source string `yaml:"source"` // 目标图片源名称
+	Key    string `yaml:"key"`    // 对象键模板，支持 $1、${name}；prefix 规则可用 ${rest}，为空时使用完整标识符
+}
+
+type resolverRule struct {
+	re         *regexp.Regexp
+	sourceName string
+	source     ImageSource
+	key        string
+}
+
+// 解析结果
+type resolvedImage struct {
+	SourceName string
+	Source     ImageSource
+	Info       SourceInfo
+}
+
+var resolvers []resolverRule
+
+// 编译解析规则，必须在 initSources 之后调用
+func initResolvers() error {
+	for i, rule := range config.Resolvers {
+		var pattern string
+		switch {
+		case rule.Regex != "" && rule.Prefix != "":
+			return fmt.Errorf("解析规则 #%d 不能同时配置 prefix 和 regex", i+1)
+		case rule.Regex != "":
+			pattern = rule.Regex
+		case rule.Prefix != "":
+			pattern = "^" + regexp.QuoteMeta(rule.Prefix) + "(?P<rest>.*)$"
+		default:
+			return fmt.Errorf("解析规则 #%d 缺少 prefix 或 regex", i+1)
+		}
+
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("解析规则 #%d 正则无效: %v", i+1, err)
+		}
+		src, err := getSource(rule.Source)
+		if err != nil {
+			return fmt.Errorf("解析规则 #%d: %v", i+1, err)
+		}
+		key := rule.Key
+		if key == "" {
+			key = "$0"
+		}
+		resolvers = append(resolvers, resolverRule{re: re, sourceName: rule.Source, source: src, key: key})
+	}
+	log.Printf("✅    已加载 %d 条标识符解析规则", len(resolvers))
+	return nil
+}
+
+// 按解析链依次尝试各图片源，全部未命中时回退到默认图片源
+func resolveIdentifier(ctx context.Context, identifier string) (resolvedImage, error) {
+	var firstErr error
+	try := func(name string, src ImageSource, key string) (resolvedImage, bool) {
+		info, err := src.Stat(ctx, key)
+		if err != nil {
+			if !errors.Is(err, errImageNotFound) && firstErr == nil {
+				firstErr = err
+			}
+			return resolvedImage{}, false
+		}
+		// 优先使用转换好的同名金字塔TIFF
+		if pyramidInfo, ok := statPyramid(ctx, src, key); ok {
+			info = pyramidInfo
+		}
+		return resolvedImage{SourceName: name, Source: src, Info: info}, true
+	}
+
+	for _, rule := range resolvers {
+		match := rule.re.FindStringSubmatchIndex(identifier)
+		if match == nil {
+			continue
+		}
+		key := string(rule.re.ExpandString(nil, rule.key, identifier, match))
+		if res, ok := try(rule.sourceName, rule.source, key); ok {
+			return res, nil
+		}
+	}
+
+	name := defaultSourceName()
+	src, err := getSource(name)
+	if err != nil {
+		return resolvedImage{}, err
+	}
+	if res, ok := try(name, src, identifier); ok {
+		return res, nil
+	}
+
+	if firstErr != nil {
+		return resolvedImage{}, firstErr
+	}
+	return resolvedImage{}, fmt.Errorf("%w: %s", errImageNotFound, identifier)
+}
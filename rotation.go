@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// 旋转配置
+type RotationConfig struct {
+	Background string `yaml:"background"` // 任意角度旋转时不支持透明的格式(jpg)的填充色，#rrggbb，默认白色
+}
+
+// 解析 rotation 参数：可选 ! 前缀表示先水平镜像，角度为 0-360 的小数
+func parseRotation(rotation string) (mirror bool, angle float64, err error) {
+	s := rotation
+	if strings.HasPrefix(s, "!") {
+		mirror = true
+		s = s[1:]
+	}
+	angle, err = strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(angle) || angle < 0 || angle > 360 {
+		return false, 0, fmt.Errorf("旋转值无效: %s", rotation)
+	}
+	return mirror, math.Mod(angle, 360), nil
+}
+
+// 输出格式是否支持透明通道
+func formatSupportsAlpha(format string) bool {
+	switch format {
+	case "png", "webp", "gif", "tif", "jp2", "avif", "heic":
+		return true
+	}
+	return false
+}
+
+// 解析 #rrggbb 颜色
+func parseHexColor(s string) (vips.ColorRGBA, error) {
+	s = strings.TrimPrefix(s, "#")
+	if len(s) != 6 {
+		return vips.ColorRGBA{}, fmt.Errorf("颜色格式无效: %q", s)
+	}
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return vips.ColorRGBA{}, fmt.Errorf("颜色格式无效: %q", s)
+	}
+	return vips.ColorRGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 255}, nil
+}
+
+// 任意角度旋转露出的背景：支持透明的格式使用透明背景，否则使用配置的填充色
+func rotationBackground(format string) *vips.ColorRGBA {
+	if formatSupportsAlpha(format) {
+		return &vips.ColorRGBA{}
+	}
+	color := vips.ColorRGBA{R: 255, G: 255, B: 255, A: 255}
+	if config.Rotation.Background != "" {
+		parsed, err := parseHexColor(config.Rotation.Background)
+		if err != nil {
+			log.Printf("警告: rotation.background 无效，使用白色: %v", err)
+		} else {
+			color = parsed
+		}
+	}
+	return &color
+}
+
+// 按 IIIF 规范先镜像再顺时针旋转
+func applyRotation(img *vips.ImageRef, rotation, format string) error {
+	mirror, angle, err := parseRotation(rotation)
+	if err != nil {
+		return err
+	}
+
+	if mirror {
+		if err := img.Flip(vips.DirectionHorizontal); err != nil {
+			return err
+		}
+	}
+
+	switch angle {
+	case 0:
+		return nil
+	case 90:
+		return img.Rotate(vips.Angle90)
+	case 180:
+		return img.Rotate(vips.Angle180)
+	case 270:
+		return img.Rotate(vips.Angle270)
+	}
+
+	// 任意角度：输出为包含整个旋转后图像的外接矩形。背景色按 RGB(A) 传给 libvips，
+	// 灰度、CMYK、LAB 等其他色彩空间先转换为 sRGB（不依赖色彩管理是否已转换），16 位 RGB 保持位深
+	interp := img.Interpretation()
+	rgb := (interp == vips.InterpretationSRGB || interp == vips.InterpretationRGB16) && img.Bands() >= 3
+	if !rgb {
+		if err := img.ToColorSpace(vips.InterpretationSRGB); err != nil {
+			return err
+		}
+	}
+	if formatSupportsAlpha(format) {
+		if err := img.AddAlpha(); err != nil {
+			return err
+		}
+	}
+	if err := img.Similarity(1, angle, rotationBackground(format), 0, 0, 0, 0); err != nil {
+		return fmt.Errorf("任意角度旋转失败: %v", err)
+	}
+	return nil
+}
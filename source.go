@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// 图片不存在（所有图片源统一返回该错误，处理器据此返回404）
+var errImageNotFound = errors.New("图像不存在")
+
+// 图片源中单个对象的元信息
+type SourceInfo struct {
+	Key     string    // 对象在图片源中的键
+	Size    int64     // 字节数
+	ModTime time.Time // 最后修改时间
+	ETag    string    // 对象版本标识（MinIO ETag，本地文件为空）
+	Path    string    // 本地文件绝对路径（仅本地源有值）
+}
+
+// 图片源接口：HTTP处理器只通过该接口读取原图，新增后端无需改动处理器
+type ImageSource interface {
+	// 获取对象元信息，不存在时返回 errImageNotFound
+	Stat(ctx context.Context, key string) (SourceInfo, error)
+	// 打开对象用于读取，调用方负责关闭
+	Open(ctx context.Context, key string) (io.ReadSeekCloser, error)
+	// 列出指定前缀下的所有对象键
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// 可写入的图片源（convert 命令写回金字塔TIFF时使用）
+type WritableSource interface {
+	ImageSource
+	// 将本地文件写入为对象，已存在时覆盖。调用方负责删除 file（成功时可能已被移走）
+	PutFile(ctx context.Context, key, file string) error
+}
+
+// 图片源配置（config.yaml 中 sources 下的每一项）
+type SourceConfig struct {
+	Type        string `yaml:"type"` // file | minio | memory
+	Root        string `yaml:"root"` // file 类型的根目录
+	MinIOConfig `yaml:",inline"`
+}
+
+// 图片源构造函数
+type sourceFactory func(name string, cfg SourceConfig) (ImageSource, error)
+
+var (
+	sourceFactories = map[string]sourceFactory{}
+	sources         = map[string]ImageSource{}
+)
+
+func init() {
+	registerSourceType("file", newFileSource)
+	registerSourceType("minio", newMinIOSource)
+	registerSourceType("memory", func(string, SourceConfig) (ImageSource, error) {
+		return newMemorySource(), nil
+	})
+}
+
+// 按类型名注册图片源实现
+func registerSourceType(typ string, factory sourceFactory) {
+	sourceFactories[typ] = factory
+}
+
+// 根据配置创建所有图片源
+func initSources() error {
+	cfgs := config.Sources
+	if len(cfgs) == 0 {
+		// 兼容旧配置：由 imageDir 和 minio 生成 local / minio 两个源
+		cfgs = map[string]SourceConfig{
+			"local": {Type: "file", Root: config.ImageDir},
+		}
+		if config.ReadMinIO {
+			cfgs["minio"] = SourceConfig{Type: "minio", MinIOConfig: config.MinIO}
+		}
+	}
+
+	for name, cfg := range cfgs {
+		factory, ok := sourceFactories[cfg.Type]
+		if !ok {
+			return fmt.Errorf("图片源 %s 的类型 %q 未注册", name, cfg.Type)
+		}
+		src, err := factory(name, cfg)
+		if err != nil {
+			return fmt.Errorf("初始化图片源 %s 失败: %v", name, err)
+		}
+		sources[name] = src
+		log.Printf("✅    图片源已注册: %s (%s)", name, cfg.Type)
+	}
+
+	if _, err := getSource(defaultSourceName()); err != nil {
+		return err
+	}
+	return nil
+}
+
+// 默认图片源名称
+func defaultSourceName() string {
+	if config.DefaultSource != "" {
+		return config.DefaultSource
+	}
+	if config.ReadMinIO {
+		return "minio"
+	}
+	return "local"
+}
+
+func getSource(name string) (ImageSource, error) {
+	src, ok := sources[name]
+	if !ok {
+		return nil, fmt.Errorf("图片源 %s 未配置", name)
+	}
+	return src, nil
+}
+
+// 本地文件系统图片源
+type fileSource struct {
+	root string
+}
+
+func newFileSource(name string, cfg SourceConfig) (ImageSource, error) {
+	if cfg.Root == "" {
+		return nil, errors.New("未配置 root 目录")
+	}
+	root, err := filepath.Abs(cfg.Root)
+	if err != nil {
+		return nil, err
+	}
+	return &fileSource{root: root}, nil
+}
+
+// 将对象键映射为根目录下的文件路径，拒绝越出根目录的键
+func (s *fileSource) resolve(key string) (string, error) {
+	p := filepath.Join(s.root, filepath.FromSlash(path.Clean("/"+key)))
+	if p != s.root && !strings.HasPrefix(p, s.root+string(filepath.Separator)) {
+		return "", fmt.Errorf("非法路径: %s", key)
+	}
+	return p, nil
+}
+
+func (s *fileSource) Stat(ctx context.Context, key string) (SourceInfo, error) {
+	p, err := s.resolve(key)
+	if err != nil {
+		return SourceInfo{}, err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return SourceInfo{}, fmt.Errorf("%w: %s", errImageNotFound, key)
+		}
+		return SourceInfo{}, fmt.Errorf("读取本地图片信息失败: %v", err)
+	}
+	if fi.IsDir() {
+		return SourceInfo{}, fmt.Errorf("%w: %s", errImageNotFound, key)
+	}
+	return SourceInfo{Key: key, Size: fi.Size(), ModTime: fi.ModTime(), Path: p}, nil
+}
+
+func (s *fileSource) Open(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+	p, err := s.resolve(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("%w: %s", errImageNotFound, key)
+		}
+		return nil, fmt.Errorf("打开本地图片失败: %v", err)
+	}
+	return f, nil
+}
+
+func (s *fileSource) PutFile(ctx context.Context, key, file string) error {
+	p, err := s.resolve(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return fmt.Errorf("创建目录失败: %v", err)
+	}
+	// 同一文件系统内直接重命名
+	if err := os.Rename(file, p); err == nil {
+		return nil
+	}
+	// 否则先复制到目标目录的临时文件再重命名，避免正在读取的请求看到不完整的文件
+	in, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("打开临时文件失败: %v", err)
+	}
+	defer in.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(p), filepath.Base(p)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("创建临时文件失败: %v", err)
+	}
+	_, err = io.Copy(tmp, in)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), p)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("写入本地图片失败: %v", err)
+	}
+	return nil
+}
+
+func (s *fileSource) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(s.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("遍历本地目录失败: %v", err)
+	}
+	return keys, nil
+}
+
+// MinIO 对象存储图片源
+type minioSource struct {
+	client *minio.Client
+	bucket string
+}
+
+func newMinIOSource(name string, cfg SourceConfig) (ImageSource, error) {
+	conn := cfg.MinIOConfig
+	if conn.Endpoint == "" {
+		// 未配置连接信息时沿用顶层 minio 配置，只替换 bucket
+		conn = config.MinIO
+		conn.Bucket = cfg.Bucket
+	}
+	if conn.Bucket == "" {
+		return nil, errors.New("未配置 bucket")
+	}
+	client, err := newMinIOClient(conn)
+	if err != nil {
+		return nil, err
+	}
+	return &minioSource{client: client, bucket: conn.Bucket}, nil
+}
+
+func newMinIOClient(cfg MinIOConfig) (*minio.Client, error) {
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: cfg.UseSSL,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("❌    初始化MinIO客户端失败: %v", err)
+	}
+
+	// 测试连接
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := client.ListBuckets(ctx); err != nil {
+		return nil, fmt.Errorf("❌    无法连接到MinIO: %v", err)
+	}
+
+	log.Printf("✅    MinIO连接成功: %s", cfg.Endpoint)
+	return client, nil
+}
+
+// 将 MinIO 的"对象不存在"错误转换为 errImageNotFound
+func (s *minioSource) wrapError(key string, err error) error {
+	if code := minio.ToErrorResponse(err).Code; code == "NoSuchKey" || code == "NotFound" {
+		return fmt.Errorf("%w: %s", errImageNotFound, key)
+	}
+	return fmt.Errorf("访问MinIO对象失败: %v", err)
+}
+
+func (s *minioSource) Stat(ctx context.Context, key string) (SourceInfo, error) {
+	stat, err := s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return SourceInfo{}, s.wrapError(key, err)
+	}
+	return SourceInfo{Key: key, Size: stat.Size, ModTime: stat.LastModified, ETag: stat.ETag}, nil
+}
+
+func (s *minioSource) Open(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+	object, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, s.wrapError(key, err)
+	}
+	// GetObject 是惰性的，先 Stat 一次以尽早发现对象不存在
+	if _, err := object.Stat(); err != nil {
+		object.Close()
+		return nil, s.wrapError(key, err)
+	}
+	return object, nil
+}
+
+func (s *minioSource) PutFile(ctx context.Context, key, file string) error {
+	_, err := s.client.FPutObject(ctx, s.bucket, key, file, minio.PutObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("写入MinIO对象失败: %v", err)
+	}
+	return nil
+}
+
+func (s *minioSource) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return nil, fmt.Errorf("列出MinIO对象失败: %v", obj.Err)
+		}
+		keys = append(keys, obj.Key)
+	}
+	return keys, nil
+}
+
+// 内存图片源（用于测试和临时挂载）
+type memorySource struct {
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+}
+
+type memoryObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+func newMemorySource() *memorySource {
+	return &memorySource{objects: map[string]memoryObject{}}
+}
+
+// 写入对象
+func (s *memorySource) Put(ctx context.Context, key string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = memoryObject{data: data, modTime: time.Now()}
+	return nil
+}
+
+func (s *memorySource) PutFile(ctx context.Context, key, file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("读取临时文件失败: %v", err)
+	}
+	return s.Put(ctx, key, data)
+}
+
+func (s *memorySource) get(key string) (memoryObject, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	obj, ok := s.objects[key]
+	if !ok {
+		return memoryObject{}, fmt.Errorf("%w: %s", errImageNotFound, key)
+	}
+	return obj, nil
+}
+
+func (s *memorySource) Stat(ctx context.Context, key string) (SourceInfo, error) {
+	obj, err := s.get(key)
+	if err != nil {
+		return SourceInfo{}, err
+	}
+	return SourceInfo{Key: key, Size: int64(len(obj.data)), ModTime: obj.modTime}, nil
+}
+
+func (s *memorySource) Open(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+	obj, err := s.get(key)
+	if err != nil {
+		return nil, err
+	}
+	return nopReadSeekCloser{bytes.NewReader(obj.data)}, nil
+}
+
+func (s *memorySource) List(ctx context.Context, prefix string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var keys []string
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// 内存数据的读取器，同时支持 ReadAt 供文件头探测使用
+type nopReadSeekCloser struct {
+	*bytes.Reader
+}
+
+func (nopReadSeekCloser) Close() error { return nil }
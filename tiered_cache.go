@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// 两层缓存配置（派生图缓存、info.json 元数据缓存共用）
+type TieredCacheConfig struct {
+	Enabled  bool `yaml:"enabled"`  // 是否启用
+	Disk     bool `yaml:"disk"`     // 是否启用磁盘层（cacheDir 下的独立分区）
+	Redis    bool `yaml:"redis"`    // 是否启用Redis层（需要Redis已连接）
+	RedisTTL int  `yaml:"redisTTL"` // Redis层过期时间，单位为秒，0表示使用该缓存的默认值
+}
+
+// 磁盘层 + Redis层缓存：读取时依次查询磁盘层和Redis层，写入时写入所有启用的层
+type tieredCache struct {
+	name        string          // 日志中的名称
+	disk        *diskCacheSpace // 磁盘层，为nil表示不启用
+	redisPrefix string          // Redis键前缀
+	useRedis    bool            // 是否启用Redis层
+	redisTTL    time.Duration   // Redis层过期时间
+}
+
+// 按配置打开两层缓存，未启用时返回 nil。partition 为 cacheDir 下的磁盘分区，
+// 必须在 initRedis 之后调用
+func openTieredCache(cfg TieredCacheConfig, name, partition, redisPrefix string, defaultTTL time.Duration) (*tieredCache, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	tc := &tieredCache{name: name, redisPrefix: redisPrefix, redisTTL: defaultTTL}
+	if cfg.RedisTTL > 0 {
+		tc.redisTTL = time.Duration(cfg.RedisTTL) * time.Second
+	}
+	if cfg.Disk {
+		disk, err := openDiskCacheSpace(partition)
+		if err != nil {
+			return nil, fmt.Errorf("初始化%s磁盘缓存失败: %v", name, err)
+		}
+		tc.disk = disk
+	}
+	if cfg.Redis {
+		if redisClient == nil {
+			log.Printf("警告: Redis未初始化，%s缓存仅使用磁盘层", name)
+		} else {
+			tc.useRedis = true
+		}
+	}
+
+	log.Printf("✅ %s缓存已启用: disk=%v redis=%v", name, tc.disk != nil, tc.useRedis)
+	return tc, nil
+}
+
+func (tc *tieredCache) redisKey(key string) string {
+	return tc.redisPrefix + key
+}
+
+// 读取缓存，依次查询磁盘层和Redis层，Redis命中时回填磁盘层
+func (tc *tieredCache) Get(key string) ([]byte, bool) {
+	if tc.disk != nil {
+		if data, ok := tc.disk.Get(key); ok {
+			return data, true
+		}
+	}
+
+	if tc.useRedis {
+		data, err := redisClient.Get(context.Background(), tc.redisKey(key)).Bytes()
+		if err == nil {
+			tc.writeDisk(key, data)
+			return data, true
+		}
+		if !errors.Is(err, redis.Nil) {
+			log.Printf("读取%s Redis缓存失败: %v", tc.name, err)
+		}
+	}
+	return nil, false
+}
+
+// 写入所有启用的缓存层
+func (tc *tieredCache) Put(key string, data []byte) {
+	tc.writeDisk(key, data)
+	if tc.useRedis {
+		if err := redisClient.Set(context.Background(), tc.redisKey(key), data, tc.redisTTL).Err(); err != nil {
+			log.Printf("写入%s Redis缓存失败: %v", tc.name, err)
+		}
+	}
+}
+
+func (tc *tieredCache) writeDisk(key string, data []byte) {
+	if tc.disk == nil {
+		return
+	}
+	if err := tc.disk.Put(key, data); err != nil {
+		log.Printf("写入%s磁盘缓存失败: %v", tc.name, err)
+	}
+}